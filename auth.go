@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/djavorszky/ddn-common/inet"
+	"github.com/djavorszky/ddn-common/logger"
+)
+
+// Requests to the agent are signed with the shared secret of the master and
+// the agent (conf.Secret). The signature is the hex encoded HMAC-SHA256 of the
+// following lines, joined with "\n":
+//
+//	the method, e.g. POST
+//	the path and the query of the request, e.g. /jobs/1
+//	the unix timestamp of the request, as sent in the timestamp header
+//	the hex encoded SHA-256 of the body of the request
+//
+// Downloads of exports are signed with query parameters instead, so that the
+// URL can be handed out. Its signature is of the lines "GET", the path and the
+// unix timestamp of when the URL expires.
+const (
+	timestampHeader = "X-DDN-Timestamp"
+	signatureHeader = "X-DDN-Signature"
+)
+
+const (
+	// maxClockSkew is how far the timestamp of a request may be from the
+	// clock of the agent.
+	maxClockSkew = 5 * time.Minute
+
+	// maxSignedBody is the largest body a signed request may have, as it is
+	// read into memory to verify it.
+	maxSignedBody = 1 << 20
+
+	// exportURLTTL is how long a signed URL of an export is valid.
+	exportURLTTL = 24 * time.Hour
+)
+
+// publicRoutes are the routes that can be called without a signature.
+var publicRoutes = map[string]bool{
+	"heartbeat": true,
+}
+
+// authenticate rejects the requests to inner that are not signed with the
+// secret of the agent. If no secret is configured, every request is accepted.
+// The metrics are only public if public-metrics is set, as Prometheus can't
+// sign its requests, but they tell anyone about the jobs of the agent.
+func authenticate(inner http.Handler, name string) http.Handler {
+	if publicRoutes[name] || (name == "metrics" && conf.PublicMetrics) {
+		return inner
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if conf.Secret == "" {
+			inner.ServeHTTP(w, r)
+			return
+		}
+
+		if err := verifyRequest(r, conf.Secret); err != nil {
+			reject(w, r, err)
+			return
+		}
+
+		inner.ServeHTTP(w, r)
+	})
+}
+
+// authenticateExport rejects the downloads of exports that are not requested
+// with a valid, unexpired signed URL.
+func authenticateExport(inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if conf.Secret == "" {
+			inner.ServeHTTP(w, r)
+			return
+		}
+
+		if err := verifyExportURL(r.URL, conf.Secret); err != nil {
+			reject(w, r, err)
+			return
+		}
+
+		inner.ServeHTTP(w, r)
+	})
+}
+
+func reject(w http.ResponseWriter, r *http.Request, err error) {
+	logger.Warn("Rejected %s %s from %s: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+
+	msg := inet.Message{Status: statusUnauthorized, Message: "Unauthorized: " + err.Error()}
+
+	inet.SendResponse(w, http.StatusUnauthorized, msg)
+}
+
+// sign returns the signature of the lines with the secret.
+func sign(secret string, lines ...string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join(lines, "\n")))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyRequest returns an error if the request is not signed with the secret,
+// or if it was signed too long ago. The body of the request is restored so
+// that it can be read again.
+func verifyRequest(r *http.Request, secret string) error {
+	timestamp := r.Header.Get(timestampHeader)
+	signature := r.Header.Get(signatureHeader)
+
+	if timestamp == "" || signature == "" {
+		return fmt.Errorf("request is not signed")
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %q", timestamp)
+	}
+
+	if skew := time.Since(time.Unix(unix, 0)); skew > maxClockSkew || skew < -maxClockSkew {
+		return fmt.Errorf("timestamp is more than %s off", maxClockSkew)
+	}
+
+	var body []byte
+	if r.Body != nil {
+		body, err = ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, maxSignedBody))
+		r.Body.Close()
+
+		if err != nil {
+			return fmt.Errorf("reading body failed: %s", err.Error())
+		}
+	}
+
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	bodySum := sha256.Sum256(body)
+	expected := sign(secret, r.Method, r.URL.RequestURI(), timestamp, hex.EncodeToString(bodySum[:]))
+
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return fmt.Errorf("invalid signature")
+	}
+
+	return nil
+}
+
+// exportURL returns the URL the export can be downloaded from. If the agent
+// has a secret, the URL is signed and expires after exportURLTTL.
+func exportURL(filename string) string {
+	if conf.Secret == "" {
+		return conf.AgentAddr + "/exports/" + url.PathEscape(filename)
+	}
+
+	return conf.AgentAddr + signExportURL(filename, time.Now().Add(exportURLTTL), conf.Secret)
+}
+
+// signExportURL returns the path and the query of the signed URL of the
+// export, which is valid until the given time.
+func signExportURL(filename string, expires time.Time, secret string) string {
+	path := "/exports/" + url.PathEscape(filename)
+	unix := strconv.FormatInt(expires.Unix(), 10)
+
+	query := url.Values{}
+	query.Set("expires", unix)
+	query.Set("signature", sign(secret, http.MethodGet, path, unix))
+
+	return path + "?" + query.Encode()
+}
+
+// verifyExportURL returns an error if the URL of an export is not signed with
+// the secret, or if it has expired.
+func verifyExportURL(u *url.URL, secret string) error {
+	expires := u.Query().Get("expires")
+	signature := u.Query().Get("signature")
+
+	if expires == "" || signature == "" {
+		return fmt.Errorf("URL is not signed")
+	}
+
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid expiry %q", expires)
+	}
+
+	if time.Now().After(time.Unix(unix, 0)) {
+		return fmt.Errorf("URL has expired")
+	}
+
+	expected := sign(secret, http.MethodGet, u.EscapedPath(), expires)
+
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return fmt.Errorf("invalid signature")
+	}
+
+	return nil
+}
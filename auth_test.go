@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func signedRequest(method, target, body, secret string, at time.Time) *http.Request {
+	r := httptest.NewRequest(method, target, bytes.NewBufferString(body))
+
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	bodySum := sha256.Sum256([]byte(body))
+
+	r.Header.Set(timestampHeader, timestamp)
+	r.Header.Set(signatureHeader, sign(secret, method, r.URL.RequestURI(), timestamp, hex.EncodeToString(bodySum[:])))
+
+	return r
+}
+
+func TestAuthenticate(t *testing.T) {
+	defer func(secret string, public bool) { conf.Secret, conf.PublicMetrics = secret, public }(conf.Secret, conf.PublicMetrics)
+	conf.Secret = "s3cret"
+	conf.PublicMetrics = false
+
+	var got string
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		got = string(body)
+	})
+
+	tampered := signedRequest("POST", "/drop-database", `{"database_name":"a"}`, "s3cret", time.Now())
+	tampered.Body = ioutil.NopCloser(bytes.NewBufferString(`{"database_name":"b"}`))
+
+	cases := []struct {
+		name  string
+		route string
+		req   *http.Request
+		code  int
+	}{
+		{"valid", "dropDatabase", signedRequest("POST", "/drop-database", `{"database_name":"a"}`, "s3cret", time.Now()), http.StatusOK},
+		{"unsigned", "dropDatabase", httptest.NewRequest("POST", "/drop-database", nil), http.StatusUnauthorized},
+		{"wrong secret", "dropDatabase", signedRequest("POST", "/drop-database", "", "other", time.Now()), http.StatusUnauthorized},
+		{"old", "listJobs", signedRequest("GET", "/jobs", "", "s3cret", time.Now().Add(-time.Hour)), http.StatusUnauthorized},
+		{"tampered", "dropDatabase", tampered, http.StatusUnauthorized},
+		{"heartbeat", "heartbeat", httptest.NewRequest("GET", "/heartbeat", nil), http.StatusOK},
+		{"unsigned metrics", "metrics", httptest.NewRequest("GET", "/metrics", nil), http.StatusUnauthorized},
+	}
+
+	for _, c := range cases {
+		got = ""
+		w := httptest.NewRecorder()
+
+		authenticate(inner, c.route).ServeHTTP(w, c.req)
+
+		if w.Code != c.code {
+			t.Errorf("Error; %s request should return %d, got %d", c.name, c.code, w.Code)
+		}
+	}
+
+	conf.PublicMetrics = true
+
+	w := httptest.NewRecorder()
+	authenticate(inner, "metrics").ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Error; unsigned metrics request should return %d if they're public, got %d", http.StatusOK, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	authenticate(inner, "dropDatabase").ServeHTTP(w, signedRequest("POST", "/drop-database", "body", "s3cret", time.Now()))
+
+	if got != "body" {
+		t.Errorf("Error; body of a signed request should be readable, got %q", got)
+	}
+}
+
+func TestExportURL(t *testing.T) {
+	signed, _ := url.Parse(signExportURL("db_1.sql.gz", time.Now().Add(time.Hour), "s3cret"))
+	if err := verifyExportURL(signed, "s3cret"); err != nil {
+		t.Errorf("Error; signed URL should be valid: %v", err)
+	}
+
+	if err := verifyExportURL(signed, "other"); err == nil {
+		t.Errorf("Error; URL signed with another secret should be invalid")
+	}
+
+	other, _ := url.Parse("/exports/other.zip?" + signed.RawQuery)
+	if err := verifyExportURL(other, "s3cret"); err == nil {
+		t.Errorf("Error; signature of another file should be invalid")
+	}
+
+	expired, _ := url.Parse(signExportURL("db_1.sql.gz", time.Now().Add(-time.Minute), "s3cret"))
+	if err := verifyExportURL(expired, "s3cret"); err == nil {
+		t.Errorf("Error; expired URL should be invalid")
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/djavorszky/ddn-common/logger"
+)
+
+// The formats exports can be compressed with.
+const (
+	compressZip  = "zip"
+	compressGzip = "gzip"
+	compressZstd = "zstd"
+	compressNone = "none"
+)
+
+// The highest compression levels of the formats. zstd goes higher, but those
+// levels need a lot of memory.
+const (
+	maxDeflateLevel = flate.BestCompression
+	maxZstdLevel    = 19
+)
+
+// zstdMissing is set if the zstd command, which compresses exports with zstd,
+// is not installed.
+var zstdMissing bool
+
+// checkCompressCommands looks up the commands used to compress exports, so
+// that the formats that can't be used are rejected when the export is
+// requested, instead of after the dump.
+func checkCompressCommands() {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		zstdMissing = true
+
+		logger.Warn("zstd is not installed, exports can't be compressed with zstd")
+	}
+}
+
+// compression is the format and the level an export is compressed with. A
+// level of 0 means the default level of the format.
+type compression struct {
+	format string
+	level  int
+}
+
+// parseCompression returns the compression of an export. If the format is
+// empty, the dump is zipped.
+func parseCompression(format string, level int) (compression, error) {
+	c := compression{format: strings.ToLower(format), level: level}
+	if c.format == "" {
+		c.format = compressZip
+	}
+
+	var maxLevel int
+
+	switch c.format {
+	case compressZip, compressGzip:
+		maxLevel = maxDeflateLevel
+	case compressZstd:
+		if zstdMissing {
+			return c, fmt.Errorf("zstd compression is not supported, as zstd is not installed")
+		}
+
+		maxLevel = maxZstdLevel
+	case compressNone:
+		maxLevel = 0
+	default:
+		return c, fmt.Errorf("unsupported compression %q, should be one of zip, gzip, zstd or none", format)
+	}
+
+	if level < 0 || level > maxLevel {
+		return c, fmt.Errorf("compression level of %s should be between 0 and %d", c.format, maxLevel)
+	}
+
+	return c, nil
+}
+
+// filename returns the name of the compressed file of the dump.
+func (c compression) filename(dump string) string {
+	switch c.format {
+	case compressZip:
+		return strings.TrimSuffix(dump, filepath.Ext(dump)) + ".zip"
+	case compressGzip:
+		return dump + ".gz"
+	case compressZstd:
+		return dump + ".zst"
+	}
+
+	return dump
+}
+
+// newWriter returns a writer that compresses the dump written to it into w.
+// The name of the dump is stored in the archive if the format supports it.
+// The writer has to be closed to flush the compressed data.
+func (c compression) newWriter(w io.Writer, dump string) (io.WriteCloser, error) {
+	switch c.format {
+	case compressZip:
+		return newZipWriter(w, dump, c.level)
+	case compressGzip:
+		level := c.level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+
+		gz, err := gzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, fmt.Errorf("creating gzip writer failed: %s", err.Error())
+		}
+
+		gz.Name = dump
+		gz.ModTime = time.Now()
+
+		return gz, nil
+	case compressZstd:
+		args := []string{"-q", "-c"}
+		if c.level > 0 {
+			args = append(args, fmt.Sprintf("-%d", c.level))
+		}
+
+		return newCommandWriter(w, "zstd", args...)
+	}
+
+	return nopWriteCloser{w}, nil
+}
+
+// compressFile compresses the dump at the path into the file at dst.
+func (c compression) compressFile(path, dst string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("opening dump failed: %s", err.Error())
+	}
+	defer src.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("could not create output file: %s", err.Error())
+	}
+	defer out.Close()
+
+	cw, err := c.newWriter(out, filepath.Base(path))
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(cw, src)
+	if cerr := cw.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return fmt.Errorf("compressing dump failed: %s", err.Error())
+	}
+
+	return out.Close()
+}
+
+// zipWriter writes a single file into a zip archive.
+type zipWriter struct {
+	io.Writer
+	zw *zip.Writer
+}
+
+func newZipWriter(w io.Writer, name string, level int) (*zipWriter, error) {
+	zw := zip.NewWriter(w)
+
+	if level > 0 {
+		zw.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(out, level)
+		})
+	}
+
+	header := &zip.FileHeader{Name: name, Method: zip.Deflate}
+	header.SetModTime(time.Now())
+
+	f, err := zw.CreateHeader(header)
+	if err != nil {
+		return nil, fmt.Errorf("creating zip entry failed: %s", err.Error())
+	}
+
+	return &zipWriter{Writer: f, zw: zw}, nil
+}
+
+// Close writes the central directory of the archive.
+func (z *zipWriter) Close() error {
+	return z.zw.Close()
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// commandWriter feeds the data written to it to a command, which writes its
+// output to another writer.
+type commandWriter struct {
+	cmd    *exec.Cmd
+	in     io.WriteCloser
+	stderr bytes.Buffer
+}
+
+func newCommandWriter(w io.Writer, name string, args ...string) (*commandWriter, error) {
+	cw := &commandWriter{cmd: exec.Command(name, args...)}
+
+	cw.cmd.Stdout = w
+	cw.cmd.Stderr = &cw.stderr
+
+	in, err := cw.cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("could not create pipe for %s: %s", name, err.Error())
+	}
+
+	cw.in = in
+
+	if err = cw.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("could not execute %s command: %s", name, err.Error())
+	}
+
+	return cw, nil
+}
+
+func (cw *commandWriter) Write(p []byte) (int, error) {
+	return cw.in.Write(p)
+}
+
+// Close waits for the command to process everything written to it.
+func (cw *commandWriter) Close() error {
+	cw.in.Close()
+
+	if err := cw.cmd.Wait(); err != nil {
+		msg := strings.TrimSpace(cw.stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+
+		return fmt.Errorf("%s failed: %s", cw.cmd.Args[0], msg)
+	}
+
+	return nil
+}
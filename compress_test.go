@@ -0,0 +1,124 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestParseCompression(t *testing.T) {
+	cases := []struct {
+		format string
+		level  int
+		ok     bool
+	}{
+		{"", 0, true},
+		{"zip", 9, true},
+		{"GZIP", 1, true},
+		{"zstd", 19, true},
+		{"none", 0, true},
+		{"gzip", 10, false},
+		{"zstd", -1, false},
+		{"none", 3, false},
+		{"rar", 0, false},
+	}
+
+	for _, c := range cases {
+		_, err := parseCompression(c.format, c.level)
+		if (err == nil) != c.ok {
+			t.Errorf("Error; parseCompression(%q, %d) should succeed: %t, got %v", c.format, c.level, c.ok, err)
+		}
+	}
+}
+
+func TestCompressionFilename(t *testing.T) {
+	cases := []struct {
+		format, dump, want string
+	}{
+		{compressZip, "db_1.sql", "db_1.zip"},
+		{compressZip, "SCHEMA_1.dmp", "SCHEMA_1.zip"},
+		{compressZip, "db_1.bak", "db_1.zip"},
+		{compressGzip, "db_1.sql", "db_1.sql.gz"},
+		{compressZstd, "db_1.sql", "db_1.sql.zst"},
+		{compressNone, "db_1.sql", "db_1.sql"},
+	}
+
+	for _, c := range cases {
+		if got := (compression{format: c.format}).filename(c.dump); got != c.want {
+			t.Errorf("Error; %s name of %q should be %q, got %q", c.format, c.dump, c.want, got)
+		}
+	}
+}
+
+func TestParseCompressionWithoutZstd(t *testing.T) {
+	zstdMissing = true
+	defer func() { zstdMissing = false }()
+
+	if _, err := parseCompression("zstd", 0); err == nil || !strings.Contains(err.Error(), "not installed") {
+		t.Errorf("Error; zstd compression should be rejected without zstd, got %v", err)
+	}
+
+	if _, err := parseCompression("gzip", 0); err != nil {
+		t.Errorf("Error; gzip compression should not need zstd, got %v", err)
+	}
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	dump := strings.Repeat("INSERT INTO a VALUES (1);\n", 1000)
+
+	formats := []string{compressZip, compressGzip, compressNone}
+	if _, err := exec.LookPath("zstd"); err == nil {
+		formats = append(formats, compressZstd)
+	}
+
+	for _, format := range formats {
+		comp, _ := parseCompression(format, 1)
+		if format == compressNone {
+			comp.level = 0
+		}
+
+		var buf bytes.Buffer
+
+		cw, err := comp.newWriter(&buf, "db_1.sql")
+		if err != nil {
+			t.Errorf("Error; creating %s writer failed: %v", format, err)
+			continue
+		}
+
+		cw.Write([]byte(dump))
+
+		if err = cw.Close(); err != nil {
+			t.Errorf("Error; closing %s writer failed: %v", format, err)
+			continue
+		}
+
+		var got []byte
+
+		if format == compressZip {
+			zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil || len(zr.File) != 1 || zr.File[0].Name != "db_1.sql" {
+				t.Errorf("Error; zip archive is invalid: %v", err)
+				continue
+			}
+
+			f, _ := zr.File[0].Open()
+			got, err = ioutil.ReadAll(f)
+		} else {
+			r, _, err := decompressStream(&buf)
+			if err != nil {
+				t.Errorf("Error; decompressing %s failed: %v", format, err)
+				continue
+			}
+
+			got, err = ioutil.ReadAll(r)
+			r.Close()
+		}
+
+		if string(got) != dump {
+			t.Errorf("Error; %s round trip returned %d bytes instead of %d", format, len(got), len(dump))
+		}
+	}
+}
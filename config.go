@@ -25,9 +25,52 @@ type Config struct {
 	AgentName      string `toml:"agent-longname"`
 	MasterAddress  string `toml:"server-address" required:"true"`
 	LogLevel       string `toml:"log-level" `
+	LogFormat      string `toml:"log-format"`
+	LogMaxAge      string `toml:"log-max-age"`
+	LogMaxFiles    int    `toml:"log-max-files"`
+	LogCompress    bool   `toml:"log-compress"`
 	StartupDelay   string `toml:"startup-delay"`
+	MaxJobs        int    `toml:"max-concurrent-jobs"`
+	Secret         string `toml:"agent-secret"`
+	TLSCert        string `toml:"tls-cert"`
+	TLSKey         string `toml:"tls-key"`
+	MasterCA       string `toml:"master-ca"`
+	ClientCert     string `toml:"master-client-cert"`
+	ClientKey      string `toml:"master-client-key"`
+
+	// PublicMetrics lets /metrics be scraped without a signature.
+	PublicMetrics bool `toml:"public-metrics"`
+
+	// ShutdownTimeout is how long the running jobs are waited for on shutdown.
+	ShutdownTimeout string `toml:"shutdown-timeout"`
+
+	// MaxExtractedSize is the most an archive may expand to, in megabytes.
+	MaxExtractedSize int64 `toml:"max-extracted-size"`
+
+	// LogMaxSize is the size in megabytes the log file is rotated at.
+	LogMaxSize int64 `toml:"log-max-size"`
+
+	// MaxCompressionRatio is the most an archive may expand to, relative to
+	// its own size.
+	MaxCompressionRatio int64 `toml:"max-compression-ratio"`
+
+	// Charset, Collation and Locale are the defaults of the databases created
+	// by the agent, if the request does not specify them.
+	Charset   string `toml:"default-charset"`
+	Collation string `toml:"default-collation"`
+	Locale    string `toml:"default-locale"`
 }
 
+// defaultMaxJobs is the number of imports and exports that are run at the
+// same time if it's not configured.
+const defaultMaxJobs = 2
+
+// The limits of archive extraction if they're not configured.
+const (
+	defaultMaxExtractedSize    = 100 * 1024
+	defaultMaxCompressionRatio = 200
+)
+
 // Print prints the Config object to the log.
 func (c Config) Print() {
 	logger.Info("Vendor:\t\t%s", conf.Vendor)
@@ -52,6 +95,38 @@ func (c Config) Print() {
 	logger.Info("Agent name:\t%s", conf.AgentName)
 
 	logger.Info("Master address:\t%s", conf.MasterAddress)
+
+	if conf.Secret != "" {
+		logger.Info("Secret:\t\t****")
+	} else {
+		logger.Info("Secret:\t\tnot set, requests are not authenticated")
+	}
+
+	if conf.PublicMetrics {
+		logger.Info("Metrics:\t\tpublic, served without a signature")
+	}
+
+	if conf.TLSCert != "" {
+		logger.Info("TLS certificate:\t%s", conf.TLSCert)
+	}
+
+	if conf.MasterCA != "" {
+		logger.Info("Master CA:\t\t%s", conf.MasterCA)
+	}
+
+	if conf.ClientCert != "" {
+		logger.Info("Client certificate:\t%s", conf.ClientCert)
+	}
+
+	logger.Info("Max jobs:\t\t%d", conf.MaxJobs)
+	logger.Info("Max extracted size:\t%d MB", conf.MaxExtractedSize)
+	logger.Info("Max compression ratio:\t%d", conf.MaxCompressionRatio)
+
+	if conf.Charset != "" || conf.Collation != "" || conf.Locale != "" {
+		logger.Info("Default charset:\t%s", conf.Charset)
+		logger.Info("Default collation:\t%s", conf.Collation)
+		logger.Info("Default locale:\t%s", conf.Locale)
+	}
 }
 
 // NewConfig returns a configuration file based on the vendor
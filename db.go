@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"strings"
 
 	"github.com/djavorszky/ddn-common/model"
@@ -9,6 +12,33 @@ import (
 
 var vendors = []string{"mysql", "mariadb", "oracle", "postgres", "mssql"}
 
+// errTargetExists is returned, wrapped, by CreateDatabase and CopyDatabase if
+// the database or the user of the request already exists. The database is not
+// the agent's to drop then, as it belongs to someone else.
+var errTargetExists = errors.New("already exists")
+
+// errSourceBusy is returned, wrapped, by CopyDatabase if the source database
+// can't be copied while other sessions are connected to it. Nothing is created
+// in that case.
+var errSourceBusy = errors.New("is being accessed by other sessions, close them and try again")
+
+type createdKey struct{}
+
+// withCreated returns a context that carries fn, which CopyDatabase calls once
+// it created the database of the request. Until then, the database is not the
+// agent's to drop if the copy fails.
+func withCreated(ctx context.Context, fn func()) context.Context {
+	return context.WithValue(ctx, createdKey{}, fn)
+}
+
+// databaseCreated reports that the database of the request was created, if the
+// context carries a function for it.
+func databaseCreated(ctx context.Context) {
+	if fn, ok := ctx.Value(createdKey{}).(func()); ok {
+		fn()
+	}
+}
+
 const (
 	createDB int = iota
 	dropDB
@@ -24,7 +54,8 @@ type Database interface {
 	// Close closes the connection to the database
 	Close()
 
-	// Alive checks whether the connection is alive. Returns error if not.
+	// Alive checks whether the connection is alive. Returns error if not. Failed
+	// checks are counted in aliveFailures, wherever they're made.
 	Alive() error
 
 	// CreateDatabase creates a Database along with a user, to which all privileges
@@ -36,12 +67,19 @@ type Database interface {
 	DropDatabase(dbRequest model.DBRequest) error
 
 	// ImportDatabase imports the dumpfile to the database or returns an error
-	// if it failed for some reason.
-	ImportDatabase(dbRequest model.DBRequest) error
+	// if it failed for some reason. The import is stopped if the context is done.
+	ImportDatabase(ctx context.Context, dbRequest model.DBRequest) error
 
 	// ExportDatabase exports a CloudDB database to a dump file and returns the file's name, or returns an error
-	// if it failed for some reason.
-	ExportDatabase(dbRequest model.DBRequest) (string, error)
+	// if it failed for some reason. The export is stopped if the context is done.
+	ExportDatabase(ctx context.Context, dbRequest model.DBRequest) (string, error)
+
+	// CopyDatabase copies the source database on the same server to the database of the
+	// request, along with a user, the same way CreateDatabase does. Fails if the database
+	// or user already exists, with errTargetExists, in which case nothing is created. Once
+	// the database is created, databaseCreated is called with the context. The copy is
+	// stopped if the context is done.
+	CopyDatabase(ctx context.Context, source string, dbRequest model.DBRequest) error
 
 	// ListDatabase returns a list of strings - the names of the databases in the server
 	// All system tables are omitted from the returned list. If there's an error, it is returned.
@@ -59,6 +97,38 @@ type Database interface {
 	ValidateDump(path string) (string, error)
 }
 
+// StreamImporter is implemented by the databases whose dumps can be imported
+// while they are being downloaded, without staging them on the disk first.
+type StreamImporter interface {
+	// ImportStream imports the dump read from r to the database or returns an error
+	// if it failed for some reason. The import is stopped if the context is done.
+	ImportStream(ctx context.Context, dbRequest model.DBRequest, r io.Reader) error
+
+	// FilteredPrefixes returns the beginnings of the lines that have to be removed
+	// from the dump before it is imported.
+	FilteredPrefixes() []string
+}
+
+// StreamExporter is implemented by the databases whose dumps are written by a
+// client, so that they can be compressed while they are being written.
+type StreamExporter interface {
+	// ExportStream writes the dump of the database to w or returns an error
+	// if it failed for some reason. The export is stopped if the context is done.
+	ExportStream(ctx context.Context, dbRequest model.DBRequest, w io.Writer) error
+}
+
+// OptionsCreator is implemented by the databases that can be created with a
+// charset, a collation or a locale other than the defaults of the agent.
+type OptionsCreator interface {
+	// ValidateOptions returns an error if the server does not support the
+	// options. Empty fields are not checked.
+	ValidateOptions(opts DatabaseOptions) error
+
+	// CreateDatabaseWithOptions works the same way as CreateDatabase, except
+	// that the database is created with the options.
+	CreateDatabaseWithOptions(dbRequest model.DBRequest, opts DatabaseOptions) error
+}
+
 // VendorSupported returns an error if the specified vendor is not supported.
 func VendorSupported(vendor string) error {
 	vendor = strings.ToLower(vendor)
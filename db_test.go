@@ -1,6 +1,15 @@
 package main
 
-import "testing"
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/djavorszky/ddn-common/model"
+)
 
 var (
 	passingCases = []string{"mysql", "mariadb", "oracle", "postgres", "MySQL", "Oracle", "PostgrEs"}
@@ -86,3 +95,146 @@ func TestGetDB_Two(t *testing.T) {
 	}
 
 }
+
+func TestOracleTargetExists(t *testing.T) {
+	cases := []struct {
+		name string
+		res  CommandResult
+		want bool
+	}{
+		{"tablespace exists", CommandResult{stdout: "ORA-01543: tablespace 'COPY' already exists", exitCode: 31}, true},
+		{"user exists", CommandResult{stdout: "ORA-01920: user name 'COPY' conflicts with another user or role name", exitCode: 128}, true},
+		{"other error", CommandResult{stdout: "ORA-01031: insufficient privileges", exitCode: 7}, false},
+	}
+
+	for _, c := range cases {
+		if got := oracleTargetExists(c.res); got != c.want {
+			t.Errorf("Error; %s: expected %t, got %t", c.name, c.want, got)
+		}
+	}
+}
+
+func TestAliveFailuresCounted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ddn-fake")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fake := filepath.Join(dir, "sqlplus")
+	ioutil.WriteFile(fake, []byte("#!/bin/sh\ncat >/dev/null\nexit 1\n"), 0700)
+
+	exec, addr := conf.Exec, conf.LocalDBAddr
+	defer func() { conf.Exec, conf.LocalDBAddr = exec, addr }()
+	conf.Exec, conf.LocalDBAddr = fake, "localhost:1521"
+
+	failures := func() float64 {
+		aliveFailures.mu.Lock()
+		defer aliveFailures.mu.Unlock()
+
+		return aliveFailures.values[""]
+	}
+
+	before := failures()
+
+	// The check made before creating the schema is counted like the one of
+	// the heartbeat, and the cached failure is not counted again.
+	if err := (&oracle{}).CreateDatabase(model.DBRequest{Username: "schema"}); err == nil {
+		t.Fatalf("Error; CreateDatabase should have failed on the alive check")
+	}
+
+	if got := failures() - before; got != 1 {
+		t.Errorf("Error; expected 1 failed alive check to be counted, got %v", got)
+	}
+}
+
+// stubDB is a Database that records the databases dropped through it, and
+// the contents of the dumps imported through it. Imports and copies fail with
+// importErr and copyErr if they're set.
+type stubDB struct {
+	mu        sync.Mutex
+	dropped   []string
+	imported  []string
+	databases []string
+	importErr error
+	copyErr   error
+
+	// copyCreates makes CopyDatabase report that it created the database
+	// before it returns copyErr.
+	copyCreates bool
+}
+
+func (s *stubDB) Connect(c Config) error                         { return nil }
+func (s *stubDB) Close()                                         {}
+func (s *stubDB) Alive() error                                   { return nil }
+func (s *stubDB) CreateDatabase(dbRequest model.DBRequest) error { return nil }
+
+func (s *stubDB) DropDatabase(dbRequest model.DBRequest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Oracle schemas are identified by the user only.
+	name := dbRequest.DatabaseName
+	if name == "" {
+		name = dbRequest.Username
+	}
+
+	s.dropped = append(s.dropped, name)
+
+	return nil
+}
+
+func (s *stubDB) ImportDatabase(ctx context.Context, dbRequest model.DBRequest) error {
+	if s.importErr != nil {
+		return s.importErr
+	}
+
+	content, err := ioutil.ReadFile(dbRequest.DumpLocation)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.imported = append(s.imported, string(content))
+
+	return nil
+}
+
+func (s *stubDB) ExportDatabase(ctx context.Context, dbRequest model.DBRequest) (string, error) {
+	return "", nil
+}
+
+func (s *stubDB) CopyDatabase(ctx context.Context, source string, dbRequest model.DBRequest) error {
+	if s.copyCreates {
+		databaseCreated(ctx)
+	}
+
+	return s.copyErr
+}
+
+func (s *stubDB) ListDatabase() ([]string, error) { return s.databases, nil }
+func (s *stubDB) Version() (string, error)        { return "1", nil }
+
+func (s *stubDB) RequiredFields(dbRequest model.DBRequest, reqType int) []string {
+	return nil
+}
+
+func (s *stubDB) ValidateDump(path string) (string, error) { return path, nil }
+
+func (s *stubDB) drops() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string{}, s.dropped...)
+}
+
+// useDB replaces the database of the agent, and returns a function that
+// restores it.
+func useDB(d Database) func() {
+	old := db
+	db = d
+
+	return func() { db = old }
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/djavorszky/ddn-common/status"
+)
+
+// A dropped download is retried downloadRetries times, waiting twice as long
+// before every attempt, starting with downloadBackoff.
+const (
+	downloadRetries = 5
+	downloadBackoff = 2 * time.Second
+)
+
+// downloadPath returns the path downloadFile places the file from the url at.
+func downloadPath(dest, url string) string {
+	return filepath.Join(dest, url[strings.LastIndex(url, "/")+1:])
+}
+
+// downloadFile downloads the file from the url and places it into the `dest`
+// folder. It works the same way as inet.DownloadFile, except that the download
+// is resumed if the connection drops, and is stopped when the context is done.
+// If sum is not nil, the checksum of the downloaded file is verified as well.
+func downloadFile(ctx context.Context, dest, url string, sum *checksum) (string, error) {
+	path := downloadPath(dest, url)
+
+	out, err := os.Create(path)
+	if err != nil {
+		return "", fmt.Errorf("could not create file: %s", err.Error())
+	}
+	defer out.Close()
+
+	body, err := openURL(ctx, url)
+	if err != nil {
+		os.Remove(path)
+
+		return "", err
+	}
+	defer body.Close()
+
+	var w io.Writer = out
+	if sum != nil {
+		w = io.MultiWriter(out, sum)
+	}
+
+	_, err = io.Copy(w, trackProgress(ctx, body, body.length, status.DownloadInProgress, "Downloading"))
+	if err != nil {
+		os.Remove(path)
+
+		return "", fmt.Errorf("downloading file failed: %s", err.Error())
+	}
+
+	if sum != nil {
+		if err = sum.verify(); err != nil {
+			os.Remove(path)
+
+			return "", err
+		}
+	}
+
+	return path, nil
+}
+
+// openURL starts downloading the url and returns the body of the response. If
+// reading the body fails midway, the rest of it is requested again with a Range
+// header. The download is stopped when the context is done.
+func openURL(ctx context.Context, url string) (*resumableReader, error) {
+	rr := &resumableReader{ctx: ctx, url: url, length: -1}
+
+	err := rr.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return rr, nil
+}
+
+// resumableReader reads the body of a HTTP response, and reconnects
+// to the server if the connection drops, continuing where it left off.
+type resumableReader struct {
+	ctx    context.Context
+	url    string
+	body   io.ReadCloser
+	offset int64
+
+	// length is the size of the whole body, or -1 if it's not known.
+	length int64
+
+	// validator is the strong ETag or the Last-Modified of the first response,
+	// sent in If-Range when resuming, so that the rest of another version of
+	// the dump is not appended to what's been read.
+	validator string
+}
+
+func (rr *resumableReader) Read(p []byte) (int, error) {
+	if rr.body == nil {
+		return 0, fmt.Errorf("download of '%s' was not resumed", rr.url)
+	}
+
+	n, err := rr.body.Read(p)
+	rr.offset += int64(n)
+	downloadedBytes.add(float64(n))
+
+	if err == nil || err == io.EOF || rr.ctx.Err() != nil {
+		return n, err
+	}
+
+	logFor(rr.ctx).Warn("Download of %q dropped after %d bytes: %v", rr.url, rr.offset, err)
+
+	rr.body.Close()
+
+	if oerr := rr.open(); oerr != nil {
+		return n, fmt.Errorf("resuming download failed: %v (original error: %v)", oerr, err)
+	}
+
+	return n, nil
+}
+
+func (rr *resumableReader) Close() error {
+	if rr.body == nil {
+		return nil
+	}
+
+	return rr.body.Close()
+}
+
+// open requests the url starting from the current offset, retrying with an
+// exponential backoff if it fails.
+func (rr *resumableReader) open() error {
+	var err error
+
+	backoff := downloadBackoff
+	for attempt := 0; attempt <= downloadRetries; attempt++ {
+		if attempt > 0 {
+			logFor(rr.ctx).Warn("Retrying download of %q in %s: %v", rr.url, backoff, err)
+
+			select {
+			case <-rr.ctx.Done():
+				return rr.ctx.Err()
+			case <-time.After(backoff):
+			}
+
+			backoff *= 2
+		}
+
+		var retry bool
+
+		rr.body, retry, err = rr.request()
+		if err == nil || !retry {
+			return err
+		}
+	}
+
+	return err
+}
+
+// request sends a single request for the url, starting from the current offset.
+// It also returns whether the request should be retried if it failed.
+func (rr *resumableReader) request() (io.ReadCloser, bool, error) {
+	req, err := http.NewRequest(http.MethodGet, rr.url, nil)
+	if err != nil {
+		return nil, false, fmt.Errorf("couldn't create request for url '%s': %s", rr.url, err.Error())
+	}
+
+	if rr.offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", rr.offset))
+
+		if rr.validator != "" {
+			req.Header.Set("If-Range", rr.validator)
+		}
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(rr.ctx))
+	if err != nil {
+		return nil, rr.ctx.Err() == nil, fmt.Errorf("couldn't get url '%s': %s", rr.url, err.Error())
+	}
+
+	switch {
+	case rr.offset == 0 && resp.StatusCode == http.StatusOK:
+		rr.length = resp.ContentLength
+
+		rr.validator = resp.Header.Get("ETag")
+		if rr.validator == "" || strings.HasPrefix(rr.validator, "W/") {
+			rr.validator = resp.Header.Get("Last-Modified")
+		}
+
+		return resp.Body, false, nil
+	case rr.offset > 0 && resp.StatusCode == http.StatusPartialContent:
+		err = rr.checkContentRange(resp.Header.Get("Content-Range"))
+		if err == nil {
+			return resp.Body, false, nil
+		}
+	}
+
+	resp.Body.Close()
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	// What's been read so far was already used, so the download can't start
+	// over from the beginning.
+	if rr.offset > 0 && resp.StatusCode == http.StatusOK {
+		return nil, false, fmt.Errorf("'%s' changed on the server or the server does not support resuming downloads", rr.url)
+	}
+
+	return nil, resp.StatusCode >= 500, fmt.Errorf("couldn't get url '%s': got response %q", rr.url, resp.Status)
+}
+
+// checkContentRange returns an error if the Content-Range of a resumed download
+// does not continue from the current offset, or is of a body of another size.
+func (rr *resumableReader) checkContentRange(contentRange string) error {
+	var start, end, total int64
+
+	_, err := fmt.Sscanf(contentRange, "bytes %d-%d/%d", &start, &end, &total)
+	if err != nil {
+		// The size of the whole body may be unknown to the server.
+		total = -1
+
+		_, err = fmt.Sscanf(contentRange, "bytes %d-%d/*", &start, &end)
+	}
+
+	if err != nil {
+		return fmt.Errorf("invalid Content-Range %q when resuming '%s'", contentRange, rr.url)
+	}
+
+	if start != rr.offset {
+		return fmt.Errorf("resuming '%s' at byte %d returned content from byte %d", rr.url, rr.offset, start)
+	}
+
+	if rr.length >= 0 && total >= 0 && total != rr.length {
+		return fmt.Errorf("'%s' changed on the server: size was %d, now %d", rr.url, rr.length, total)
+	}
+
+	return nil
+}
+
+// errChecksumMismatch is returned, wrapped, by downloadFile if the checksum of
+// the downloaded file is not the expected one.
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// checksum verifies the checksum of the data written to it.
+type checksum struct {
+	algorithm string
+	expected  string
+	hash.Hash
+}
+
+// parseChecksum parses a checksum in the form of "sha256:<hex>" or "md5:<hex>".
+// If the algorithm is missing, it is guessed based on the length of the
+// checksum. Returns nil if the checksum is empty.
+func parseChecksum(sum string) (*checksum, error) {
+	if sum == "" {
+		return nil, nil
+	}
+
+	algorithm, expected := "", strings.ToLower(sum)
+	if i := strings.Index(expected, ":"); i >= 0 {
+		algorithm, expected = expected[:i], expected[i+1:]
+	}
+
+	if _, err := hex.DecodeString(expected); err != nil {
+		return nil, fmt.Errorf("checksum %q is not hexadecimal", expected)
+	}
+
+	if algorithm == "" {
+		switch len(expected) {
+		case 2 * sha256.Size:
+			algorithm = "sha256"
+		case 2 * md5.Size:
+			algorithm = "md5"
+		}
+	}
+
+	c := &checksum{algorithm: algorithm, expected: expected}
+
+	switch algorithm {
+	case "sha256":
+		c.Hash = sha256.New()
+	case "md5":
+		c.Hash = md5.New()
+	default:
+		return nil, fmt.Errorf("unsupported checksum algorithm %q", algorithm)
+	}
+
+	if len(expected) != 2*c.Size() {
+		return nil, fmt.Errorf("%s checksum should be %d characters long", algorithm, 2*c.Size())
+	}
+
+	return c, nil
+}
+
+// verify returns an error if the checksum of the data written so far does
+// not match the expected one.
+func (c *checksum) verify() error {
+	actual := hex.EncodeToString(c.Sum(nil))
+	if actual != c.expected {
+		return fmt.Errorf("%s %w: expected %s, got %s", c.algorithm, errChecksumMismatch, c.expected, actual)
+	}
+
+	return nil
+}
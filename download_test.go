@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseChecksum(t *testing.T) {
+	passing := []string{
+		"",
+		"md5:d41d8cd98f00b204e9800998ecf8427e",
+		"d41d8cd98f00b204e9800998ecf8427e",
+		"SHA256:E3B0C44298FC1C149AFBF4C8996FB92427AE41E4649B934CA495991B7852B855",
+		"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+	}
+
+	failing := []string{
+		"md5",
+		"sha1:da39a3ee5e6b4b0d3255bfef95601890afd80709",
+		"md5:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		"sha256:not-hex",
+	}
+
+	for _, sum := range passing {
+		if _, err := parseChecksum(sum); err != nil {
+			t.Errorf("Error; Should have passed, but failed for %q: %v", sum, err)
+		}
+	}
+
+	for _, sum := range failing {
+		if _, err := parseChecksum(sum); err == nil {
+			t.Errorf("Error; Should have failed, but passed for %q", sum)
+		}
+	}
+}
+
+func TestOpenURLResumes(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+
+		if requests == 1 {
+			// Promise the whole content, but drop the connection halfway.
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.Write(content[:len(content)/2])
+			return
+		}
+
+		http.ServeContent(w, r, "dump.sql", time.Now(), bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	body, err := openURL(context.Background(), srv.URL+"/dump.sql")
+	if err != nil {
+		t.Fatalf("Error; opening url failed: %v", err)
+	}
+	defer body.Close()
+
+	got, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatalf("Error; reading body failed: %v", err)
+	}
+
+	if !bytes.Equal(got, content) {
+		t.Errorf("Error; expected %d bytes, got %d", len(content), len(got))
+	}
+
+	if requests != 2 {
+		t.Errorf("Error; expected 2 requests, got %d", requests)
+	}
+}
+
+func TestOpenURLRejectsOtherContent(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	changed := bytes.Repeat([]byte("9876543210"), 10000)
+
+	cases := []struct {
+		name   string
+		resume func(w http.ResponseWriter, r *http.Request)
+	}{
+		{"range ignored", func(w http.ResponseWriter, r *http.Request) {
+			w.Write(content)
+		}},
+		{"wrong offset", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(content)-1, len(content)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(content)
+		}},
+		{"changed", func(w http.ResponseWriter, r *http.Request) {
+			// ServeContent answers with the whole new content, as If-Range
+			// does not match its ETag.
+			w.Header().Set("ETag", `"v2"`)
+			http.ServeContent(w, r, "dump.sql", time.Time{}, bytes.NewReader(changed))
+		}},
+	}
+
+	for _, c := range cases {
+		var requests int
+		var ifRange string
+
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+
+			if requests == 1 {
+				w.Header().Set("ETag", `"v1"`)
+				w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+				w.Write(content[:len(content)/2])
+				return
+			}
+
+			ifRange = r.Header.Get("If-Range")
+			c.resume(w, r)
+		}))
+
+		body, err := openURL(context.Background(), srv.URL+"/dump.sql")
+		if err != nil {
+			t.Fatalf("Error; %s: opening url failed: %v", c.name, err)
+		}
+
+		if _, err = ioutil.ReadAll(body); err == nil {
+			t.Errorf("Error; %s: resuming with other content should fail", c.name)
+		}
+
+		if ifRange != `"v1"` {
+			t.Errorf("Error; %s: expected If-Range with the first ETag, got %q", c.name, ifRange)
+		}
+
+		body.Close()
+		srv.Close()
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/djavorszky/ddn-common/logger"
+)
+
+// The formats of dumps, as detected by their first few bytes.
+const (
+	formatPlain = ""
+	formatZip   = "zip"
+	formatTar   = "tar"
+	formatGzip  = "gzip"
+	formatBzip2 = "bzip2"
+	formatXz    = "xz"
+	formatZstd  = "zstd"
+	formatLz4   = "lz4"
+	format7z    = "7z"
+	formatRar   = "rar"
+)
+
+// sniffLen is the number of bytes needed to detect the format of a dump. A
+// tarball is recognized by the "ustar" magic at offset 257 of its header.
+const sniffLen = 512
+
+var magicNumbers = []struct {
+	format string
+	magic  []byte
+}{
+	{formatZip, []byte("PK\x03\x04")},
+	{formatZip, []byte("PK\x05\x06")},
+	{formatGzip, []byte("\x1f\x8b")},
+	{formatBzip2, []byte("BZh")},
+	{formatXz, []byte("\xfd7zXZ\x00")},
+	{formatZstd, []byte("\x28\xb5\x2f\xfd")},
+	{formatLz4, []byte("\x04\x22\x4d\x18")},
+	{format7z, []byte("7z\xbc\xaf\x27\x1c")},
+	{formatRar, []byte("Rar!\x1a\x07")},
+}
+
+// decompressCommands are the commands used to decompress the formats that
+// the standard library can't handle. The compressed data is passed on stdin.
+var decompressCommands = map[string][]string{
+	formatXz:   {"xz", "-dc"},
+	formatZstd: {"zstd", "-dc"},
+	formatLz4:  {"lz4", "-dc"},
+}
+
+// missingCommands are the decompressCommands that are not installed, by the
+// formats they decompress. Dumps of these formats are not supported.
+var missingCommands = make(map[string]string)
+
+// checkDecompressCommands looks up the commands in decompressCommands, so that
+// dumps that can't be decompressed are rejected with a clear error.
+func checkDecompressCommands() {
+	for format, args := range decompressCommands {
+		if _, err := exec.LookPath(args[0]); err != nil {
+			missingCommands[format] = args[0]
+
+			logger.Warn("%s is not installed, %s compressed dumps can't be imported", args[0], format)
+		}
+	}
+}
+
+// sniffFormat returns the format of the data based on its first bytes.
+func sniffFormat(head []byte) string {
+	for _, m := range magicNumbers {
+		if bytes.HasPrefix(head, m.magic) {
+			return m.format
+		}
+	}
+
+	if len(head) >= 262 && string(head[257:262]) == "ustar" {
+		return formatTar
+	}
+
+	return formatPlain
+}
+
+// detectFormat returns the format of the file at the path.
+func detectFormat(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("opening dump failed: %s", err.Error())
+	}
+	defer file.Close()
+
+	head := make([]byte, sniffLen)
+
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", fmt.Errorf("reading dump failed: %s", err.Error())
+	}
+
+	return sniffFormat(head[:n]), nil
+}
+
+// sniff returns the format of the data in r, along with a reader that
+// returns all of the data, including the bytes that were sniffed.
+func sniff(r io.Reader) (string, io.Reader) {
+	br := bufio.NewReaderSize(r, sniffLen)
+
+	// Errors are returned again by the next read.
+	head, _ := br.Peek(sniffLen)
+
+	return sniffFormat(head), br
+}
+
+// checkSupported returns an error if dumps of the format can't be imported.
+func checkSupported(format string) error {
+	if format == format7z || format == formatRar {
+		return fmt.Errorf("%s archives are not supported", format)
+	}
+
+	if name, ok := missingCommands[format]; ok {
+		return fmt.Errorf("%s archives are not supported, as %s is not installed", format, name)
+	}
+
+	return nil
+}
+
+// newDecompressor returns a reader that decompresses r, which is in the format.
+func newDecompressor(format string, r io.Reader) (io.ReadCloser, error) {
+	switch format {
+	case formatGzip:
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("creating gzip reader failed: %s", err.Error())
+		}
+
+		return gz, nil
+	case formatBzip2:
+		return ioutil.NopCloser(bzip2.NewReader(r)), nil
+	}
+
+	args, ok := decompressCommands[format]
+	if !ok {
+		return nil, fmt.Errorf("decompressing %s is not supported", format)
+	}
+
+	if err := checkSupported(format); err != nil {
+		return nil, err
+	}
+
+	return newCommandReader(r, args[0], args[1:]...)
+}
+
+// commandReader reads the output of a command that is fed from a reader.
+type commandReader struct {
+	cmd    *exec.Cmd
+	out    io.ReadCloser
+	stderr bytes.Buffer
+
+	once sync.Once
+	err  error
+	eof  bool
+}
+
+func newCommandReader(r io.Reader, name string, args ...string) (*commandReader, error) {
+	cr := &commandReader{cmd: exec.Command(name, args...)}
+
+	cr.cmd.Stderr = &cr.stderr
+
+	// The input is copied by the reader instead of exec, as Wait would wait
+	// for exec's copy to finish, which never happens while reading a stalled
+	// download. The copy ends once the pipe is closed by Wait.
+	in, err := cr.cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("could not create pipe for %s: %s", name, err.Error())
+	}
+
+	out, err := cr.cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("could not create pipe for %s: %s", name, err.Error())
+	}
+
+	cr.out = out
+
+	if err = cr.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("could not execute %s command: %s", name, err.Error())
+	}
+
+	go func() {
+		io.Copy(in, r)
+		in.Close()
+	}()
+
+	return cr, nil
+}
+
+func (cr *commandReader) Read(p []byte) (int, error) {
+	if cr.eof {
+		if cr.err != nil {
+			return 0, cr.err
+		}
+
+		return 0, io.EOF
+	}
+
+	n, err := cr.out.Read(p)
+	if err == io.EOF {
+		cr.eof = true
+
+		if werr := cr.wait(); werr != nil {
+			return n, werr
+		}
+	}
+
+	return n, err
+}
+
+// Close stops the command if it's still running, without waiting for the
+// input to be read.
+func (cr *commandReader) Close() error {
+	cr.once.Do(func() {
+		cr.cmd.Process.Kill()
+		cr.cmd.Wait()
+	})
+
+	return nil
+}
+
+// wait waits for the command to exit, and returns an error if it failed.
+func (cr *commandReader) wait() error {
+	cr.once.Do(func() {
+		if err := cr.cmd.Wait(); err != nil {
+			msg := strings.TrimSpace(cr.stderr.String())
+			if msg == "" {
+				msg = err.Error()
+			}
+
+			cr.err = fmt.Errorf("%s failed: %s", cr.cmd.Args[0], msg)
+		}
+	})
+
+	return cr.err
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSniffFormat(t *testing.T) {
+	tarHeader := make([]byte, 512)
+	copy(tarHeader[257:], "ustar")
+
+	cases := map[string][]byte{
+		formatPlain: []byte("CREATE TABLE a;"),
+		formatZip:   []byte("PK\x03\x04rest"),
+		formatGzip:  []byte("\x1f\x8b\x08"),
+		formatBzip2: []byte("BZh91AY"),
+		formatXz:    []byte("\xfd7zXZ\x00\x00"),
+		formatZstd:  []byte("\x28\xb5\x2f\xfd\x00"),
+		formatLz4:   []byte("\x04\x22\x4d\x18\x00"),
+		format7z:    []byte("7z\xbc\xaf\x27\x1c\x00"),
+		formatTar:   tarHeader,
+	}
+
+	for want, head := range cases {
+		if got := sniffFormat(head); got != want {
+			t.Errorf("Error; format of %.10q should be %q, got %q", head, want, got)
+		}
+	}
+}
+
+func TestDecompressStream(t *testing.T) {
+	const dump = "CREATE TABLE a;\n"
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(dump))
+	zw.Close()
+
+	inputs := map[string][]byte{
+		"plain": []byte(dump),
+		"gzip":  gz.Bytes(),
+	}
+
+	if _, err := exec.LookPath("xz"); err == nil {
+		out, err := exec.Command("sh", "-c", "printf '"+strings.TrimSpace(dump)+"\\n' | xz -c").Output()
+		if err != nil {
+			t.Fatalf("Error; could not compress with xz: %v", err)
+		}
+
+		inputs["xz"] = out
+	}
+
+	for name, input := range inputs {
+		r, ok, err := decompressStream(bytes.NewReader(input))
+		if err != nil || !ok {
+			t.Errorf("Error; decompressing %s failed: %t, %v", name, ok, err)
+			continue
+		}
+
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+
+		if err != nil || string(got) != dump {
+			t.Errorf("Error; decompressing %s: expected %q, got %q (%v)", name, dump, got, err)
+		}
+	}
+
+	if _, ok, err := decompressStream(bytes.NewReader([]byte("PK\x03\x04"))); ok || err != nil {
+		t.Errorf("Error; a zip archive should not be streamed, got %t, %v", ok, err)
+	}
+}
+
+func TestCommandReaderCloseStalledInput(t *testing.T) {
+	if _, err := exec.LookPath("cat"); err != nil {
+		t.Skip("cat is not installed")
+	}
+
+	// The input never delivers anything, like a stalled download.
+	pr, pw := io.Pipe()
+	defer pw.Close()
+
+	cr, err := newCommandReader(pr, "cat")
+	if err != nil {
+		t.Fatalf("Error; could not start cat: %v", err)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		cr.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Error; closing a command with stalled input should not block")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -23,11 +24,11 @@ func index(w http.ResponseWriter, r *http.Request) {
 
 func createDatabase(w http.ResponseWriter, r *http.Request) {
 	var (
-		dbreq model.DBRequest
-		msg   inet.Message
+		req CreateRequest
+		msg inet.Message
 	)
 
-	err := json.NewDecoder(r.Body).Decode(&dbreq)
+	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
 		logger.Error("couldn't decode json request: %v", err)
 
@@ -35,6 +36,11 @@ func createDatabase(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	secrets.add(req.Password)
+	defer secrets.remove(req.Password)
+
+	dbreq := req.DBRequest
+
 	if ok := sutils.Present(db.RequiredFields(dbreq, createDB)...); !ok {
 		logger.Error("createDatabase: missing fields: dbreq: %v", dbreq)
 
@@ -42,8 +48,28 @@ func createDatabase(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err = validateRequest(conf.Vendor, dbreq); err != nil {
+		msg.Status = status.ClientError
+		msg.Message = fmt.Sprintf("Invalid request: %v", err)
+
+		logger.Error("invalid request: %v", err)
+
+		inet.SendResponse(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	if err = validateOptions(req.DatabaseOptions); err != nil {
+		msg.Status = status.ClientError
+		msg.Message = fmt.Sprintf("Invalid database options: %v", err)
+
+		logger.Error("invalid database options: %v", err)
+
+		inet.SendResponse(w, http.StatusBadRequest, msg)
+		return
+	}
+
 	httpStatus := http.StatusOK
-	err = db.CreateDatabase(dbreq)
+	err = createWithOptions(dbreq, req.DatabaseOptions)
 	if err != nil {
 		httpStatus = http.StatusInternalServerError
 		msg.Status = status.CreateDatabaseFailed
@@ -114,6 +140,9 @@ func dropDatabase(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	secrets.add(dbreq.Password)
+	defer secrets.remove(dbreq.Password)
+
 	if ok := sutils.Present(db.RequiredFields(dbreq, dropDB)...); !ok {
 		logger.Error("dropDatabase: missing fields: dbreq: %v", dbreq)
 
@@ -121,6 +150,16 @@ func dropDatabase(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err = validateRequest(conf.Vendor, dbreq); err != nil {
+		msg.Status = status.ClientError
+		msg.Message = fmt.Sprintf("Invalid request: %v", err)
+
+		logger.Error("invalid request: %v", err)
+
+		inet.SendResponse(w, http.StatusBadRequest, msg)
+		return
+	}
+
 	httpStatus := http.StatusOK
 
 	err = db.DropDatabase(dbreq)
@@ -144,11 +183,11 @@ func dropDatabase(w http.ResponseWriter, r *http.Request) {
 // creating the database, tablespace and user
 func importDatabase(w http.ResponseWriter, r *http.Request) {
 	var (
-		dbreq model.DBRequest
-		msg   inet.Message
+		req JobRequest
+		msg inet.Message
 	)
 
-	err := json.NewDecoder(r.Body).Decode(&dbreq)
+	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
 		logger.Error("couldn't decode json request: %v", err)
 
@@ -156,6 +195,11 @@ func importDatabase(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	secrets.add(req.Password)
+	defer secrets.remove(req.Password)
+
+	dbreq := req.DBRequest
+
 	if ok := sutils.Present(db.RequiredFields(dbreq, importDB)...); !ok {
 		logger.Error("importDatabase: missing fields: dbreq: %v", dbreq)
 
@@ -163,6 +207,36 @@ func importDatabase(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err = validateRequest(conf.Vendor, dbreq); err != nil {
+		msg.Status = status.ClientError
+		msg.Message = fmt.Sprintf("Invalid request: %v", err)
+
+		logger.Error("invalid request: %v", err)
+
+		inet.SendResponse(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	if err = validateOptions(req.DatabaseOptions); err != nil {
+		msg.Status = status.ClientError
+		msg.Message = fmt.Sprintf("Invalid database options: %v", err)
+
+		logger.Error("invalid database options: %v", err)
+
+		inet.SendResponse(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	if _, err = parseChecksum(req.Checksum); err != nil {
+		msg.Status = status.ClientError
+		msg.Message = fmt.Sprintf("Invalid checksum: %v", err)
+
+		logger.Error("invalid checksum: %v", err)
+
+		inet.SendResponse(w, http.StatusBadRequest, msg)
+		return
+	}
+
 	if exists := inet.AddrExists(dbreq.DumpLocation); !exists {
 		msg.Status = status.NotFound
 		msg.Message = fmt.Sprintf("Specified file doesn't exist or is not reachable at location %q.", dbreq.DumpLocation)
@@ -173,7 +247,7 @@ func importDatabase(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = db.CreateDatabase(dbreq)
+	err = createWithOptions(dbreq, req.DatabaseOptions)
 	if err != nil {
 		msg.Status = status.CreateDatabaseFailed
 		msg.Message = fmt.Sprintf("creating database failed: %v", err)
@@ -189,19 +263,138 @@ func importDatabase(w http.ResponseWriter, r *http.Request) {
 	msg.Status = status.Accepted
 	msg.Message = "Understood request, starting import process."
 
+	j := jobs.add(importJob, req, requestID(r))
+
+	logger.Debug("Registered import job %d for database %q", j.id, dbreq.DatabaseName)
+
+	inet.SendResponse(w, http.StatusOK, msg)
+
+	go jobs.run(j, startImport)
+}
+
+// copyDatabase copies an existing database to a new database and user on the
+// same server, as a job.
+func copyDatabase(w http.ResponseWriter, r *http.Request) {
+	var (
+		req JobRequest
+		msg inet.Message
+	)
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logger.Error("couldn't decode json request: %v", err)
+
+		inet.SendResponse(w, http.StatusBadRequest, inet.ErrorJSONResponse(err))
+		return
+	}
+
+	secrets.add(req.Password)
+	defer secrets.remove(req.Password)
+
+	dbreq := req.DBRequest
+
+	if ok := sutils.Present(append(db.RequiredFields(dbreq, createDB), req.SourceDatabase)...); !ok {
+		logger.Error("copyDatabase: missing fields: dbreq: %v, source: %q", dbreq, req.SourceDatabase)
+
+		inet.SendResponse(w, http.StatusBadRequest, inet.InvalidResponse())
+		return
+	}
+
+	err = validateRequest(conf.Vendor, dbreq)
+	if err == nil {
+		err = validateRequest(conf.Vendor, model.DBRequest{DatabaseName: req.SourceDatabase})
+	}
+
+	if err != nil {
+		msg.Status = status.ClientError
+		msg.Message = fmt.Sprintf("Invalid request: %v", err)
+
+		logger.Error("invalid request: %v", err)
+
+		inet.SendResponse(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	if !req.DatabaseOptions.isEmpty() {
+		msg.Status = status.ClientError
+		msg.Message = "Invalid database options: copies keep the charset, the collation and the locale of the source"
+
+		logger.Error("invalid database options for copy")
+
+		inet.SendResponse(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	databases, err := db.ListDatabase()
+	if err != nil {
+		msg.Status = status.ListDatabaseFailed
+		msg.Message = fmt.Sprintf("list databases: %v", err)
+
+		logger.Error("list databases: %v", err)
+
+		inet.SendResponse(w, http.StatusInternalServerError, msg)
+		return
+	}
+
+	if !containsName(databases, req.SourceDatabase) {
+		msg.Status = status.NotFound
+		msg.Message = fmt.Sprintf("Source database %q doesn't exist.", req.SourceDatabase)
+
+		logger.Error("source database %q doesn't exist", req.SourceDatabase)
+
+		inet.SendResponse(w, http.StatusNotFound, msg)
+		return
+	}
+
+	// Oracle schemas are named after their users.
+	target := dbreq.DatabaseName
+	if strings.ToLower(conf.Vendor) == "oracle" {
+		target = dbreq.Username
+	}
+
+	if containsName(databases, target) {
+		msg.Status = status.ClientError
+		msg.Message = fmt.Sprintf("Database %q already exists.", target)
+
+		logger.Error("database %q already exists", target)
+
+		inet.SendResponse(w, http.StatusConflict, msg)
+		return
+	}
+
+	logger.Debug("Starting copy process of database %q to %q", req.SourceDatabase, target)
+
+	msg.Status = status.Accepted
+	msg.Message = "Understood request, starting copy process."
+
+	j := jobs.add(copyJob, req, requestID(r))
+
+	logger.Debug("Registered copy job %d for database %q", j.id, target)
+
 	inet.SendResponse(w, http.StatusOK, msg)
 
-	go startImport(dbreq)
+	go jobs.run(j, startCopy)
+}
+
+// containsName returns true if the name is in the list, ignoring the case.
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+
+	return false
 }
 
 // exportDatabase will export the specified database to a dump file
 func exportDatabase(w http.ResponseWriter, r *http.Request) {
 	var (
-		dbreq model.DBRequest
-		msg   inet.Message
+		req JobRequest
+		msg inet.Message
 	)
 
-	err := json.NewDecoder(r.Body).Decode(&dbreq)
+	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
 		logger.Error("couldn't decode json request: %v", err)
 
@@ -209,14 +402,102 @@ func exportDatabase(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	secrets.add(req.Password)
+	defer secrets.remove(req.Password)
+
+	dbreq := req.DBRequest
+
+	if err = validateRequest(conf.Vendor, dbreq); err != nil {
+		msg.Status = status.ClientError
+		msg.Message = fmt.Sprintf("Invalid request: %v", err)
+
+		logger.Error("invalid request: %v", err)
+
+		inet.SendResponse(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	if _, err = parseCompression(req.Compression, req.CompressionLevel); err != nil {
+		msg.Status = status.ClientError
+		msg.Message = fmt.Sprintf("Invalid compression: %v", err)
+
+		logger.Error("invalid compression: %v", err)
+
+		inet.SendResponse(w, http.StatusBadRequest, msg)
+		return
+	}
+
 	logger.Debug("Starting export process for database %q", dbreq.DatabaseName)
 
 	msg.Status = status.Accepted
 	msg.Message = "Understood request, starting export process."
 
+	j := jobs.add(exportJob, req, requestID(r))
+
+	logger.Debug("Registered export job %d for database %q", j.id, dbreq.DatabaseName)
+
+	inet.SendResponse(w, http.StatusOK, msg)
+
+	go jobs.run(j, startExport)
+}
+
+// listJobs lists the imports and exports known by the agent.
+func listJobs(w http.ResponseWriter, r *http.Request) {
+	var msg inet.StructMessage
+
+	msg.Status = status.Success
+	msg.Message = jobs.list()
+
+	inet.SendResponse(w, http.StatusOK, msg)
+}
+
+// getJob returns the details of a single import or export.
+func getJob(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	j, ok := jobs.get(id)
+	if !ok {
+		msg := inet.Message{Status: status.NotFound, Message: fmt.Sprintf("Job %d not found", id)}
+
+		inet.SendResponse(w, http.StatusNotFound, msg)
+		return
+	}
+
+	var msg inet.StructMessage
+
+	msg.Status = status.Success
+	msg.Message = jobs.info(j)
+
 	inet.SendResponse(w, http.StatusOK, msg)
+}
+
+// cancelJob cancels a running import or export. The child process of the job is
+// killed, and the job reports the cancellation to the master once it stopped.
+func cancelJob(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	j, ok := jobs.get(id)
+	if !ok {
+		msg := inet.Message{Status: status.NotFound, Message: fmt.Sprintf("Job %d not found", id)}
 
-	go startExport(dbreq)
+		inet.SendResponse(w, http.StatusNotFound, msg)
+		return
+	}
+
+	if j.isDone() {
+		msg := inet.Message{Status: status.ClientError, Message: fmt.Sprintf("Job %d has already finished", id)}
+
+		inet.SendResponse(w, http.StatusConflict, msg)
+		return
+	}
+
+	logger.Info("Cancelling job %d", id)
+
+	j.cancel()
+
+	msg := inet.Message{Status: status.Accepted, Message: fmt.Sprintf("Cancelling job %d", id)}
+
+	inet.SendResponse(w, http.StatusOK, msg)
 }
 
 func apiSetLogLevel(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/djavorszky/ddn-common/model"
+)
+
+// identifierRule describes the names of databases and users a vendor accepts.
+// The names are quoted in the statements as well, but they are restricted to
+// characters that are safe without quoting too, as not all statements and
+// tools can quote them (e.g. the substitution variables of sqlplus).
+type identifierRule struct {
+	pattern     *regexp.Regexp
+	maxDatabase int
+	maxUser     int
+}
+
+var identifierRules = map[string]identifierRule{
+	"mysql":    {regexp.MustCompile(`^[A-Za-z0-9_$]+$`), 64, 32},
+	"mariadb":  {regexp.MustCompile(`^[A-Za-z0-9_$]+$`), 64, 80},
+	"postgres": {regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_$]*$`), 63, 63},
+	"oracle":   {regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_$#]*$`), 30, 30},
+	"mssql":    {regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_@$#]*$`), 128, 128},
+}
+
+// maxPasswordLength is the longest password accepted for any vendor.
+const maxPasswordLength = 128
+
+// validateRequest returns an error if the name of the database, the name of the
+// user or the password of the request can't be used with the vendor. Empty
+// fields are not checked, as they are validated by RequiredFields.
+func validateRequest(vendor string, dbreq model.DBRequest) error {
+	rule, ok := identifierRules[strings.ToLower(vendor)]
+	if !ok {
+		return fmt.Errorf("vendor not supported: %s", vendor)
+	}
+
+	if dbreq.DatabaseName != "" {
+		if err := rule.check("database name", dbreq.DatabaseName, rule.maxDatabase); err != nil {
+			return err
+		}
+	}
+
+	if dbreq.Username != "" {
+		if err := rule.check("username", dbreq.Username, rule.maxUser); err != nil {
+			return err
+		}
+	}
+
+	return validatePassword(vendor, dbreq.Password)
+}
+
+func (rule identifierRule) check(field, name string, maxLen int) error {
+	if len(name) > maxLen {
+		return fmt.Errorf("%s %q is longer than %d characters", field, name, maxLen)
+	}
+
+	if !rule.pattern.MatchString(name) {
+		return fmt.Errorf("%s %q contains characters that are not allowed", field, name)
+	}
+
+	return nil
+}
+
+// validatePassword returns an error if the password can't be used with the
+// vendor. Passwords are escaped in the statements, but control characters are
+// never allowed, and Oracle passwords are always in double quotes.
+func validatePassword(vendor, password string) error {
+	if len(password) > maxPasswordLength {
+		return fmt.Errorf("password is longer than %d characters", maxPasswordLength)
+	}
+
+	for _, r := range password {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("password contains control characters")
+		}
+	}
+
+	if strings.ToLower(vendor) == "oracle" && strings.ContainsAny(password, `"&`) {
+		return fmt.Errorf(`password can't contain " or & characters`)
+	}
+
+	return nil
+}
+
+// quoteMySQLIdentifier quotes the name of a database for MySQL.
+func quoteMySQLIdentifier(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+// quoteMySQLLiteral quotes a string for MySQL, e.g. a username or a password.
+func quoteMySQLLiteral(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "'", "''", -1)
+
+	return "'" + s + "'"
+}
+
+// quotePostgresLiteral quotes a string for Postgres. If it contains
+// backslashes, it's quoted as an escape string.
+func quotePostgresLiteral(s string) string {
+	s = strings.Replace(s, "'", "''", -1)
+
+	if strings.Contains(s, `\`) {
+		return "E'" + strings.Replace(s, `\`, `\\`, -1) + "'"
+	}
+
+	return "'" + s + "'"
+}
+
+// quoteMSSQLIdentifier quotes the name of a database or a user for MSSQL.
+func quoteMSSQLIdentifier(name string) string {
+	return "[" + strings.Replace(name, "]", "]]", -1) + "]"
+}
+
+// quoteMSSQLLiteral quotes a string as an unicode string for MSSQL.
+func quoteMSSQLLiteral(s string) string {
+	return "N'" + strings.Replace(s, "'", "''", -1) + "'"
+}
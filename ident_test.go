@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/djavorszky/ddn-common/model"
+)
+
+func TestValidateRequest(t *testing.T) {
+	cases := []struct {
+		vendor   string
+		database string
+		username string
+		password string
+		ok       bool
+	}{
+		{"mysql", "lportal_62", "liferay", "p'a\"s\\s", true},
+		{"mysql", "1st_db", "user$1", "", true},
+		{"mysql", "db; DROP DATABASE mysql", "user", "", false},
+		{"mysql", "db`", "user", "", false},
+		{"mysql", "db", "root'@'%", "", false},
+		{"mysql", "db", "user", "pass\x00word", false},
+		{"mysql", "db", "user", "pass\nword", false},
+		{"mysql", strings.Repeat("a", 65), "user", "", false},
+		{"mysql", "db", strings.Repeat("u", 33), "", false},
+		{"mariadb", "db", strings.Repeat("u", 33), "", true},
+		{"postgres", "lportal", "liferay", "it's", true},
+		{"postgres", "1st_db", "user", "", false},
+		{"postgres", `db" OWNER "postgres`, "user", "", false},
+		{"postgres", strings.Repeat("a", 64), "user", "", false},
+		{"mssql", "db", "user@domain", "", true},
+		{"mssql", "db]; DROP DATABASE master; --", "user", "", false},
+		{"mssql", "db", "user", "p'; --", true},
+		{"oracle", "", "LIFERAY_62", "secret", true},
+		{"oracle", "", "_user", "secret", false},
+		{"oracle", "", "user", `pass" ACCOUNT UNLOCK`, false},
+		{"oracle", "", "user", "pass&2", false},
+		{"oracle", "", strings.Repeat("u", 31), "secret", false},
+		{"db2", "db", "user", "", false},
+	}
+
+	for _, c := range cases {
+		dbreq := model.DBRequest{DatabaseName: c.database, Username: c.username, Password: c.password}
+
+		err := validateRequest(c.vendor, dbreq)
+		if (err == nil) != c.ok {
+			t.Errorf("Error; %s request %+v should be valid: %t, got %v", c.vendor, dbreq, c.ok, err)
+		}
+	}
+}
+
+func TestQuote(t *testing.T) {
+	cases := []struct {
+		name  string
+		quote func(string) string
+		in    string
+		want  string
+	}{
+		{"mysql identifier", quoteMySQLIdentifier, "db", "`db`"},
+		{"mysql identifier", quoteMySQLIdentifier, "db`; DROP DATABASE x; `", "`db``; DROP DATABASE x; ```"},
+		{"mysql literal", quoteMySQLLiteral, "pass", "'pass'"},
+		{"mysql literal", quoteMySQLLiteral, `x' OR '1'='1`, `'x'' OR ''1''=''1'`},
+		{"mysql literal", quoteMySQLLiteral, `x\'; DROP USER root; --`, `'x\\''; DROP USER root; --'`},
+		{"postgres user", postgresUser, "MyUser", `"myuser"`},
+		{"postgres user", postgresUser, `u"; DROP USER x; --`, `"u""; drop user x; --"`},
+		{"postgres user name", postgresUserName, "MyUser", "myuser"},
+		{"postgres literal", quotePostgresLiteral, "it's", "'it''s'"},
+		{"postgres literal", quotePostgresLiteral, `x\'; --`, `E'x\\''; --'`},
+		{"mssql identifier", quoteMSSQLIdentifier, "db]; DROP DATABASE master; --", "[db]]; DROP DATABASE master; --]"},
+		{"mssql literal", quoteMSSQLLiteral, "p'; DROP LOGIN sa; --", "N'p''; DROP LOGIN sa; --'"},
+	}
+
+	for _, c := range cases {
+		if got := c.quote(c.in); got != c.want {
+			t.Errorf("Error; %s of %q should be %q, got %q", c.name, c.in, c.want, got)
+		}
+	}
+}
@@ -3,135 +3,242 @@ package main
 import (
 	"archive/tar"
 	"archive/zip"
-	"compress/bzip2"
+	"bufio"
+	"bytes"
 	"compress/gzip"
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 )
 
-func unzip(path string) ([]string, error) {
-	defer os.Remove(path)
+// extractLimit caps how much data can be extracted from a single archive, so
+// that a small archive can't fill up the disk.
+type extractLimit struct {
+	remaining int64
+	reason    string
+}
 
-	r, err := zip.OpenReader(path)
+// newExtractLimit returns the limit for extracting the archive at the path,
+// which is the smaller of conf.MaxExtractedSize and conf.MaxCompressionRatio
+// times the size of the archive.
+func newExtractLimit(path string) (*extractLimit, error) {
+	fi, err := os.Stat(path)
 	if err != nil {
-		return nil, fmt.Errorf("creating zip reader failed: %s", err.Error())
+		return nil, fmt.Errorf("checking archive size failed: %s", err.Error())
 	}
-	defer r.Close()
 
-	var files []string
-	for _, f := range r.File {
-		name, err := unzipFile(f)
-		if err != nil {
-			return nil, fmt.Errorf("extracting zip file failed: %s", err.Error())
-		}
+	maxSize := conf.MaxExtractedSize * 1024 * 1024
+	l := &extractLimit{
+		remaining: maxSize,
+		reason:    fmt.Sprintf("the maximum extracted size of %s", formatBytes(maxSize)),
+	}
 
-		files = append(files, name)
+	if byRatio := fi.Size() * conf.MaxCompressionRatio; byRatio < l.remaining {
+		l.remaining = byRatio
+		l.reason = fmt.Sprintf("the maximum compression ratio of %d", conf.MaxCompressionRatio)
 	}
 
-	return files, nil
+	return l, nil
 }
 
-func unzipFile(f *zip.File) (string, error) {
-	src, err := f.Open()
+// copy copies from src to dst, and returns an error if that would exceed the limit.
+func (l *extractLimit) copy(dst io.Writer, src io.Reader) error {
+	n, err := io.CopyN(dst, src, l.remaining+1)
+	l.remaining -= n
+
+	if l.remaining < 0 {
+		return fmt.Errorf("archive expands beyond %s", l.reason)
+	}
+
+	if err == io.EOF {
+		return nil
+	}
+
+	return err
+}
+
+// extractPath returns the path where the archive entry with the name should be
+// extracted to inside the dir. It returns an error for absolute paths and paths
+// that contain "..", as those could point outside of dir.
+func extractPath(dir, name string) (string, error) {
+	slashed := strings.Replace(name, "\\", "/", -1)
+
+	if slashed == "" || strings.HasPrefix(slashed, "/") || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", fmt.Errorf("archive entry %q has an absolute path", name)
+	}
+
+	for _, elem := range strings.Split(slashed, "/") {
+		if elem == ".." {
+			return "", fmt.Errorf("archive entry %q points outside of the archive", name)
+		}
+	}
+
+	return filepath.Join(dir, filepath.FromSlash(slashed)), nil
+}
+
+// createFile creates the file for an archive entry inside dir, along with the
+// folders leading to it.
+func createFile(dir, name string) (*os.File, error) {
+	path, err := extractPath(dir, name)
 	if err != nil {
-		return "", fmt.Errorf("opening zipfile failed: %s", err.Error())
+		return nil, err
 	}
-	defer src.Close()
 
-	dst, err := os.OpenFile(f.Name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
+	err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
 	if err != nil {
-		return "", fmt.Errorf("opening destination file failed: %s", err.Error())
+		return nil, fmt.Errorf("creating destination folder failed: %s", err.Error())
 	}
-	defer dst.Close()
 
-	_, err = io.Copy(dst, src)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
 	if err != nil {
-		return "", fmt.Errorf("copying from archive failed: %s", err.Error())
+		return nil, fmt.Errorf("could not create output file: %s", err.Error())
 	}
 
-	return f.Name, nil
+	return file, nil
 }
 
-func ungzip(path string) ([]string, error) {
+// unzip extracts the zip archive at the path into the dir, and returns the
+// extracted files. Directories in the archive are recreated inside dir.
+func unzip(path, dir string) ([]string, error) {
 	defer os.Remove(path)
 
-	reader, err := os.Open(path)
+	limit, err := newExtractLimit(path)
 	if err != nil {
-		return nil, fmt.Errorf("opening gzipfile failed: %s", err.Error())
+		return nil, err
 	}
-	defer reader.Close()
 
-	archive, err := gzip.NewReader(reader)
+	r, err := zip.OpenReader(path)
 	if err != nil {
-		return nil, fmt.Errorf("creating gzip reader failed: %s", err.Error())
+		return nil, fmt.Errorf("creating zip reader failed: %s", err.Error())
 	}
-	defer archive.Close()
+	defer r.Close()
 
-	ext := filepath.Ext(path)
-	name := archive.Header.Name
-	if name == "" {
-		dstName := filepath.Base(path)
+	var files []string
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+
+		if !f.Mode().IsRegular() {
+			return files, fmt.Errorf("extracting zip file failed: archive entry %q is not a regular file", f.Name)
+		}
 
-		name = dstName[:len(dstName)-len(ext)]
+		name, err := unzipFile(f, dir, limit)
+		if name != "" {
+			files = append(files, name)
+		}
+
+		if err != nil {
+			return files, fmt.Errorf("extracting zip file failed: %s", err.Error())
+		}
 	}
 
-	dst, err := os.Create(name)
+	return files, nil
+}
+
+func unzipFile(f *zip.File, dir string, limit *extractLimit) (string, error) {
+	dst, err := createFile(dir, f.Name)
 	if err != nil {
-		return nil, fmt.Errorf("could not create output file: %s", err.Error())
+		return "", err
 	}
 	defer dst.Close()
 
-	_, err = io.Copy(dst, archive)
+	src, err := f.Open()
 	if err != nil {
-		return nil, fmt.Errorf("uncompressing gzip failed: %s", err.Error())
+		return dst.Name(), fmt.Errorf("opening zipfile failed: %s", err.Error())
 	}
+	defer src.Close()
 
-	if filepath.Ext(dst.Name()) == ".tar" {
-		dst.Close()
-		return untar(fmt.Sprintf("%s/%s", filepath.Dir(dst.Name()), dst.Name()))
+	err = limit.copy(dst, src)
+	if err != nil {
+		return dst.Name(), fmt.Errorf("copying from archive failed: %s", err.Error())
 	}
 
-	return []string{dst.Name()}, nil
+	return dst.Name(), nil
 }
 
-func unbzip2(path string) ([]string, error) {
+// decompressFile decompresses the file at the path into the dir, using the
+// given format. If the decompressed data is a tarball, it is extracted on the
+// fly, so that its contents are only counted once against the limit.
+func decompressFile(ctx context.Context, path, dir, format string) ([]string, error) {
 	defer os.Remove(path)
 
+	limit, err := newExtractLimit(path)
+	if err != nil {
+		return nil, err
+	}
+
 	reader, err := os.Open(path)
 	if err != nil {
-		return nil, fmt.Errorf("opening bzip2 file failed: %s", err.Error())
+		return nil, fmt.Errorf("opening %s file failed: %s", format, err.Error())
 	}
 	defer reader.Close()
 
-	archive := bzip2.NewReader(reader)
+	archive, err := newDecompressor(format, reader)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
 
-	ext := filepath.Ext(path)
-	dstName := filepath.Base(path)
+	inner, decompressed := sniff(archive)
+	if inner == formatTar {
+		return readTar(ctx, decompressed, dir, limit)
+	}
 
-	name := dstName[:len(dstName)-len(ext)]
+	name := decompressedName(filepath.Base(path))
+	if gz, ok := archive.(*gzip.Reader); ok && gz.Header.Name != "" {
+		name = filepath.Base(gz.Header.Name)
+	}
 
-	dst, err := os.Create(name)
+	dst, err := createFile(dir, name)
 	if err != nil {
-		return nil, fmt.Errorf("could not create output file: %s", err.Error())
+		return nil, err
 	}
 	defer dst.Close()
 
-	_, err = io.Copy(dst, archive)
+	err = limit.copy(dst, decompressed)
 	if err != nil {
-		return nil, fmt.Errorf("uncompressing bzip2 failed: %s", err.Error())
+		return []string{dst.Name()}, fmt.Errorf("uncompressing %s failed: %s", format, err.Error())
 	}
 
-	if filepath.Ext(dst.Name()) == ".tar" {
-		dst.Close()
-		return untar(fmt.Sprintf("%s/%s", filepath.Dir(dst.Name()), dst.Name()))
+	return []string{dst.Name()}, nil
+}
+
+// decompressedName returns the name of the decompressed file, based on the
+// name of the compressed one.
+func decompressedName(name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+
+	switch ext {
+	case ".tgz", ".tbz2", ".txz", ".tzst":
+		return strings.TrimSuffix(name, filepath.Ext(name)) + ".tar"
+	case ".gz", ".bz2", ".xz", ".zst", ".lz4":
+		return strings.TrimSuffix(name, filepath.Ext(name))
 	}
 
-	return []string{dst.Name()}, nil
+	return name
+}
+
+// untar extracts the tarball at the path into the dir, and returns the
+// extracted files. Directories in the tarball are recreated inside dir.
+func untar(ctx context.Context, path, dir string) ([]string, error) {
+	limit, err := newExtractLimit(path)
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	return extractTar(ctx, path, dir, limit)
 }
 
-func untar(path string) ([]string, error) {
+// extractTar extracts the tarball at the path into the dir within the limit.
+// Links are rejected, as they could point outside of dir.
+func extractTar(ctx context.Context, path, dir string, limit *extractLimit) ([]string, error) {
 	defer os.Remove(path)
 
 	file, err := os.Open(path)
@@ -141,9 +248,14 @@ func untar(path string) ([]string, error) {
 	}
 	defer file.Close()
 
+	return readTar(ctx, file, dir, limit)
+}
+
+// readTar extracts the tarball read from r into the dir within the limit.
+func readTar(ctx context.Context, r io.Reader, dir string, limit *extractLimit) ([]string, error) {
 	var files []string
 
-	tarBallReader := tar.NewReader(file)
+	tarBallReader := tar.NewReader(r)
 
 	for {
 		header, err := tarBallReader.Next()
@@ -152,89 +264,264 @@ func untar(path string) ([]string, error) {
 				break
 			}
 
-			return nil, fmt.Errorf("encountered error while reading tarball: %s", err.Error())
+			return files, fmt.Errorf("encountered error while reading tarball: %s", err.Error())
 		}
 
-		filename := header.Name
-
 		switch header.Typeflag {
 		case tar.TypeDir:
+			dirname, err := extractPath(dir, header.Name)
 			if err != nil {
-				return nil, fmt.Errorf("tarball contains folder, stopping")
+				return files, err
 			}
-		case tar.TypeReg:
-			writer, err := os.Create(filename)
+
+			err = os.MkdirAll(dirname, os.ModePerm)
 			if err != nil {
-				return nil, fmt.Errorf("could not create output file: %s", err.Error())
+				return files, fmt.Errorf("could not create folder: %s", err.Error())
 			}
-			defer writer.Close()
-
-			_, err = io.Copy(writer, tarBallReader)
+		case tar.TypeReg:
+			writer, err := createFile(dir, header.Name)
 			if err != nil {
-				return nil, fmt.Errorf("uncompressing tarball failed: %s", err.Error())
+				return files, err
 			}
 
 			files = append(files, writer.Name())
+
+			err = limit.copy(writer, tarBallReader)
+			writer.Close()
+
+			if err != nil {
+				return files, fmt.Errorf("uncompressing tarball failed: %s", err.Error())
+			}
+		case tar.TypeSymlink, tar.TypeLink:
+			return files, fmt.Errorf("archive entry %q is a link, which is not allowed", header.Name)
 		default:
-			fmt.Printf("Unable to untar type : %c in file %s", header.Typeflag, filename)
+			logFor(ctx).Warn("Unable to untar type %c in file %s, skipping", header.Typeflag, header.Name)
 		}
 	}
 
 	return files, nil
 }
 
-func isArchive(path string) bool {
-	switch filepath.Ext(path) {
-	case ".zip", ".tar", ".gz", ".bz2":
-		return true
+// manifestName is the name of the file that lists the order in which the files
+// of a multi-file archive should be imported.
+const manifestName = "manifest.txt"
+
+// dumpExtensions are the extensions of the files that are imported from an
+// archive without a manifest.
+var dumpExtensions = map[string]bool{".sql": true, ".dump": true, ".bak": true, ".dmp": true}
+
+// orderDumpFiles returns the files extracted to dir that should be imported, in
+// the order they should be imported. Hidden files and the __MACOSX folders of
+// archives made on macOS are ignored. If there's a manifest file among them, the
+// files are taken from it: one path per line, relative to the manifest, skipping
+// empty lines and lines that begin with #. Otherwise the files with the
+// extension of a dump are imported in lexical order of their paths, or the only
+// file, whatever its extension.
+func orderDumpFiles(dir string, files []string) ([]string, error) {
+	var visible []string
+	for _, f := range files {
+		if !isHiddenEntry(dir, f) {
+			visible = append(visible, f)
+		}
 	}
 
-	return false
+	for _, f := range visible {
+		if strings.EqualFold(filepath.Base(f), manifestName) {
+			return readManifest(f, visible)
+		}
+	}
+
+	if len(visible) == 1 {
+		return visible, nil
+	}
+
+	var ordered []string
+	for _, f := range visible {
+		if dumpExtensions[strings.ToLower(filepath.Ext(f))] {
+			ordered = append(ordered, f)
+		}
+	}
+
+	if len(ordered) == 0 {
+		return nil, fmt.Errorf("archive does not contain any .sql, .dump, .bak or .dmp files")
+	}
+
+	sort.Strings(ordered)
+
+	return ordered, nil
 }
 
-func zipFiles(outputZipFilename string, inputFiles []string) error {
+// isHiddenEntry returns true if any element of the path of the file inside dir
+// begins with a dot, or is a __MACOSX folder.
+func isHiddenEntry(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		rel = path
+	}
+
+	for _, elem := range strings.Split(filepath.ToSlash(rel), "/") {
+		if elem == "__MACOSX" || (strings.HasPrefix(elem, ".") && elem != ".") {
+			return true
+		}
+	}
 
-	newfile, err := os.Create(outputZipFilename)
+	return false
+}
+
+func readManifest(manifest string, files []string) ([]string, error) {
+	file, err := os.Open(manifest)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("opening manifest failed: %s", err.Error())
 	}
-	defer newfile.Close()
+	defer file.Close()
 
-	zipWriter := zip.NewWriter(newfile)
-	defer zipWriter.Close()
+	extracted := make(map[string]bool)
+	for _, f := range files {
+		extracted[filepath.Clean(f)] = true
+	}
 
-	// Add inputFiles to zip
-	for _, file := range inputFiles {
+	var ordered []string
 
-		zipfile, err := os.Open(file)
-		if err != nil {
-			return err
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
 		}
-		defer zipfile.Close()
 
-		// Get the file information
-		info, err := zipfile.Stat()
-		if err != nil {
-			return err
+		name := filepath.Join(filepath.Dir(manifest), filepath.FromSlash(line))
+		if !extracted[name] {
+			return nil, fmt.Errorf("manifest lists %q, but the archive does not contain it", line)
 		}
 
-		header, err := zip.FileInfoHeader(info)
-		if err != nil {
-			return err
+		ordered = append(ordered, name)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading manifest failed: %s", err.Error())
+	}
+
+	if len(ordered) == 0 {
+		return nil, fmt.Errorf("manifest does not list any files")
+	}
+
+	return ordered, nil
+}
+
+// canStream returns true if the dump at the path can be imported while it is
+// being read, based on its extension, i.e. it's either not compressed, or
+// compressed into a single file. The format of the dump itself is checked
+// once it's being read.
+func canStream(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".zip", ".tar", ".tgz", ".tbz2", ".txz", ".tzst", ".7z", ".rar":
+		return false
+	case ".gz", ".bz2", ".xz", ".zst", ".lz4":
+		return strings.ToLower(filepath.Ext(strings.TrimSuffix(path, filepath.Ext(path)))) != ".tar"
+	}
+
+	return true
+}
+
+// decompressStream returns a reader that decompresses r based on its format.
+// If the data is not compressed, it is returned as-is. It returns false if the
+// data can't be decompressed on the fly, as it's a zip archive or a tarball.
+func decompressStream(r io.Reader) (io.ReadCloser, bool, error) {
+	format, r := sniff(r)
+
+	switch format {
+	case formatPlain:
+		return ioutil.NopCloser(r), true, nil
+	case formatZip, formatTar:
+		return nil, false, nil
+	}
+
+	dump, err := newDecompressor(format, r)
+	if err != nil {
+		return nil, false, err
+	}
+
+	inner, sniffed := sniff(dump)
+	if inner == formatTar {
+		dump.Close()
+		return nil, false, nil
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{sniffed, dump}, true, nil
+}
+
+// filterLines returns a reader that reads from r, leaving out the lines
+// that begin with any of the prefixes.
+func filterLines(r io.Reader, prefixes []string) io.ReadCloser {
+	pr, pw := io.Pipe()
+
+	go func() {
+		pw.CloseWithError(copyWithoutPrefixes(pw, r, prefixes))
+	}()
+
+	return pr
+}
+
+// copyWithoutPrefixes copies the lines from src to dst, except the ones that
+// begin with any of the prefixes. Lines can be of any length; only as many
+// bytes are looked at as needed to decide whether a line is kept or not.
+func copyWithoutPrefixes(dst io.Writer, src io.Reader, prefixes []string) error {
+	var maxLen int
+	for _, p := range prefixes {
+		if len(p) > maxLen {
+			maxLen = len(p)
 		}
+	}
 
-		// Change to deflate to gain better compression
-		// see http://golang.org/pkg/archive/zip/#pkg-constants
-		header.Method = zip.Deflate
+	br := bufio.NewReaderSize(src, 64*1024)
+
+	for {
+		head, err := br.Peek(maxLen)
+		if len(head) == 0 {
+			if err == io.EOF {
+				return nil
+			}
 
-		writer, err := zipWriter.CreateHeader(header)
-		if err != nil {
 			return err
 		}
-		_, err = io.Copy(writer, zipfile)
-		if err != nil {
-			return err
+
+		if i := bytes.IndexByte(head, '\n'); i >= 0 {
+			head = head[:i]
+		}
+
+		skip := false
+		for _, p := range prefixes {
+			if bytes.HasPrefix(head, []byte(p)) {
+				skip = true
+				break
+			}
+		}
+
+		// Consume the line, in as many pieces as needed.
+		for {
+			chunk, err := br.ReadSlice('\n')
+			if !skip && len(chunk) > 0 {
+				if _, werr := dst.Write(chunk); werr != nil {
+					return werr
+				}
+			}
+
+			if err == bufio.ErrBufferFull {
+				continue
+			}
+
+			if err == io.EOF {
+				return nil
+			}
+
+			if err != nil {
+				return err
+			}
+
+			break
 		}
 	}
-	return nil
 }
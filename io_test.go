@@ -0,0 +1,264 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCopyWithoutPrefixes(t *testing.T) {
+	long := strings.Repeat("x", 200*1024)
+
+	cases := []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"CREATE TABLE a;\n", "CREATE TABLE a;\n"},
+		{"USE foo;\nCREATE TABLE a;\n", "CREATE TABLE a;\n"},
+		{"CREATE TABLE a;\nDROP DATABASE foo;", "CREATE TABLE a;\n"},
+		{"INSERT INTO a VALUES ('" + long + "');\nUSE foo;\n", "INSERT INTO a VALUES ('" + long + "');\n"},
+		{"USE " + long + "\nINSERT INTO a;\n", "INSERT INTO a;\n"},
+		{"\n\nUSE foo;\n\n", "\n\n\n"},
+		{"US\nINSERT INTO a;", "US\nINSERT INTO a;"},
+	}
+
+	for _, c := range cases {
+		var out bytes.Buffer
+
+		err := copyWithoutPrefixes(&out, strings.NewReader(c.in), mysqlFilteredPrefixes)
+		if err != nil {
+			t.Errorf("Error; copying %.20q failed: %v", c.in, err)
+			continue
+		}
+
+		if out.String() != c.want {
+			t.Errorf("Error; copying %.20q: expected %.20q, got %.20q", c.in, c.want, out.String())
+		}
+	}
+}
+
+func TestCanStream(t *testing.T) {
+	cases := map[string]bool{
+		"http://host/dump.sql":     true,
+		"http://host/dump.sql.gz":  true,
+		"http://host/dump.sql.bz2": true,
+		"http://host/dump.zip":     false,
+		"http://host/dump.tar":     false,
+		"http://host/dump.tar.gz":  false,
+		"http://host/dump.tar.bz2": false,
+		"http://host/dump.sql.xz":  true,
+		"http://host/dump.sql.zst": true,
+		"http://host/dump.lz4":     true,
+		"http://host/dump.tar.zst": false,
+		"http://host/dump.tgz":     false,
+	}
+
+	for path, want := range cases {
+		if got := canStream(path); got != want {
+			t.Errorf("Error; canStream(%q) should be %t, got %t", path, want, got)
+		}
+	}
+}
+
+func TestOrderDumpFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dumps")
+	if err != nil {
+		t.Fatalf("Error; could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := []string{
+		filepath.Join(dir, "dump", "data", "b.sql"),
+		filepath.Join(dir, "dump", "schema.sql"),
+		filepath.Join(dir, "dump", "data", "a.sql"),
+	}
+
+	got, err := orderDumpFiles(dir, files)
+	if err != nil {
+		t.Fatalf("Error; ordering without manifest failed: %v", err)
+	}
+
+	want := []string{files[2], files[0], files[1]}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Error; without manifest expected %v, got %v", want, got)
+	}
+
+	macOS := append([]string{
+		filepath.Join(dir, "dump", "README.txt"),
+		filepath.Join(dir, "dump", ".DS_Store"),
+		filepath.Join(dir, "__MACOSX", "dump", "._schema.sql"),
+	}, files...)
+
+	got, err = orderDumpFiles(dir, macOS)
+	if err != nil {
+		t.Fatalf("Error; ordering an archive made on macOS failed: %v", err)
+	}
+
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Error; from an archive made on macOS expected %v, got %v", want, got)
+	}
+
+	single := []string{filepath.Join(dir, "backup"), filepath.Join(dir, "__MACOSX", "._backup")}
+
+	got, err = orderDumpFiles(dir, single)
+	if err != nil || len(got) != 1 || got[0] != single[0] {
+		t.Errorf("Error; the only file should be imported whatever its extension, got %v, %v", got, err)
+	}
+
+	if _, err = orderDumpFiles(dir, []string{filepath.Join(dir, "README"), filepath.Join(dir, "LICENSE")}); err == nil {
+		t.Errorf("Error; archive without dump files should fail")
+	}
+
+	manifest := filepath.Join(dir, "dump", manifestName)
+	os.MkdirAll(filepath.Dir(manifest), 0755)
+
+	err = ioutil.WriteFile(manifest, []byte("# schema first\nschema.sql\n\ndata/b.sql\ndata/a.sql\n"), 0644)
+	if err != nil {
+		t.Fatalf("Error; could not write manifest: %v", err)
+	}
+
+	got, err = orderDumpFiles(dir, append(files, manifest))
+	if err != nil {
+		t.Fatalf("Error; ordering with manifest failed: %v", err)
+	}
+
+	want = []string{files[1], files[0], files[2]}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Error; with manifest expected %v, got %v", want, got)
+	}
+
+	ioutil.WriteFile(manifest, []byte("missing.sql\n"), 0644)
+
+	if _, err = orderDumpFiles(dir, append(files, manifest)); err == nil {
+		t.Errorf("Error; manifest listing a missing file should fail")
+	}
+}
+
+func TestExtractPath(t *testing.T) {
+	cases := map[string]bool{
+		"dump.sql":               true,
+		"data/dump.sql":          true,
+		"./data/dump.sql":        true,
+		"":                       false,
+		"/etc/cron.d/x":          false,
+		"../dump.sql":            false,
+		"data/../../dump.sql":    false,
+		"..\\..\\etc\\cron.d\\x": false,
+		"\\etc\\cron.d\\x":       false,
+	}
+
+	for name, ok := range cases {
+		path, err := extractPath("dumps/job1", name)
+		if ok && (err != nil || !strings.HasPrefix(path, filepath.Join("dumps", "job1")+string(filepath.Separator))) {
+			t.Errorf("Error; %q should be extracted inside the folder, got %q (%v)", name, path, err)
+		}
+
+		if !ok && err == nil {
+			t.Errorf("Error; %q should be rejected, got %q", name, path)
+		}
+	}
+}
+
+func TestUnzipLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dumps")
+	if err != nil {
+		t.Fatalf("Error; could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf.MaxExtractedSize = 1
+	conf.MaxCompressionRatio = 1000
+
+	writeZip := func(name string, size int) string {
+		path := filepath.Join(dir, "archive.zip")
+
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		w, _ := zw.Create(name)
+		w.Write(bytes.Repeat([]byte("x"), size))
+		zw.Close()
+
+		ioutil.WriteFile(path, buf.Bytes(), 0644)
+
+		return path
+	}
+
+	out := filepath.Join(dir, "out")
+
+	files, err := unzip(writeZip("data/dump.sql", 1024), out)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Error; unzipping a valid archive failed: %v", err)
+	}
+
+	if _, err = unzip(writeZip("../../dump.sql", 1024), out); err == nil {
+		t.Errorf("Error; unzipping an entry outside the folder should fail")
+	}
+
+	if _, err = unzip(writeZip("big.sql", 2*1024*1024), out); err == nil || !strings.Contains(err.Error(), "maximum") {
+		t.Errorf("Error; unzipping beyond the limits should fail, got %v", err)
+	}
+}
+
+func TestDecompressTarballLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dumps")
+	if err != nil {
+		t.Fatalf("Error; could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf.MaxExtractedSize = 1
+	conf.MaxCompressionRatio = 100000
+
+	writeTarGz := func(size int) string {
+		path := filepath.Join(dir, "archive.tar.gz")
+
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gz)
+		tw.WriteHeader(&tar.Header{Name: "dump.sql", Mode: 0644, Size: int64(size), Typeflag: tar.TypeReg})
+		tw.Write(bytes.Repeat([]byte("x"), size))
+		tw.Close()
+		gz.Close()
+
+		ioutil.WriteFile(path, buf.Bytes(), 0644)
+
+		return path
+	}
+
+	// The contents of the tarball are counted once, not along with the tarball.
+	files, err := decompressFile(context.Background(), writeTarGz(700*1024), filepath.Join(dir, "ok"), formatGzip)
+	if err != nil || len(files) != 1 || filepath.Base(files[0]) != "dump.sql" {
+		t.Fatalf("Error; decompressing a tarball within the limit failed: %v, %v", files, err)
+	}
+
+	if _, err = decompressFile(context.Background(), writeTarGz(2*1024*1024), filepath.Join(dir, "big"), formatGzip); err == nil {
+		t.Errorf("Error; decompressing a tarball beyond the limit should fail")
+	}
+}
+
+func TestCheckSupported(t *testing.T) {
+	missingCommands[formatLz4] = "lz4"
+	defer delete(missingCommands, formatLz4)
+
+	for format, supported := range map[string]bool{
+		formatGzip: true,
+		formatZip:  true,
+		formatRar:  false,
+		formatLz4:  false,
+	} {
+		if err := checkSupported(format); (err == nil) != supported {
+			t.Errorf("Error; checkSupported(%q) = %v, expected supported %t", format, err, supported)
+		}
+	}
+
+	if _, err := newDecompressor(formatLz4, strings.NewReader("")); err == nil || !strings.Contains(err.Error(), "not installed") {
+		t.Errorf("Error; decompressing without lz4 installed should fail clearly, got %v", err)
+	}
+}
@@ -0,0 +1,627 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/djavorszky/ddn-common/status"
+	"github.com/djavorszky/notif"
+)
+
+// The types of jobs the agent runs in the background.
+const (
+	importJob = "import"
+	exportJob = "export"
+	copyJob   = "copy"
+)
+
+// job is a long running import, export or copy. Every status change is recorded
+// on the job before it is sent to the master through notif. The context of
+// the job is cancelled if the job is cancelled on request.
+type job struct {
+	mu sync.RWMutex
+
+	// sendMu makes sure that the statuses reach the master in the same
+	// order as they are recorded.
+	sendMu sync.Mutex
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	id        int
+	jobType   string
+	req       JobRequest
+	requestID string
+	status    int
+	message   string
+	lastError string
+	created   time.Time
+	updated   time.Time
+	finished  time.Time
+
+	// phaseStarted is when the job got its current status.
+	phaseStarted time.Time
+
+	// exportFile is the name of the file of a finished export.
+	exportFile string
+
+	ch chan notif.Y
+
+	// sent is closed once the last status of the job reached the master.
+	sent chan struct{}
+
+	// cancelMsg is reported when the job is cancelled.
+	cancelMsg string
+
+	// ownsDatabase is set once the database of the request was created for
+	// the job, which is the only case it's dropped if the job fails.
+	ownsDatabase bool
+
+	// ready is closed once the job may start running.
+	ready chan struct{}
+}
+
+// phases are the statuses of the jobs whose durations are recorded, by the
+// names of the phases.
+var phases = map[int]string{
+	status.DownloadInProgress: "download",
+	status.ExtractingArchive:  "extract",
+	status.ValidatingDump:     "validate",
+	status.ImportInProgress:   "import",
+	status.ArchivingDump:      "zip",
+	status.ExportInProgress:   "export",
+	status.CopyInProgress:     "copy",
+}
+
+// JobInfo is the JSON representation of a job. The password of the request
+// is never included.
+type JobInfo struct {
+	ID          int        `json:"id"`
+	Type        string     `json:"type"`
+	Request     JobRequest `json:"request"`
+	Status      int        `json:"status"`
+	StatusLabel string     `json:"status_label"`
+	Message     string     `json:"message"`
+	LastError   string     `json:"last_error,omitempty"`
+	Created     time.Time  `json:"created"`
+	Updated     time.Time  `json:"updated"`
+	Finished    *time.Time `json:"finished,omitempty"`
+
+	// DownloadURL is where the file of a finished export can be downloaded
+	// from. It is signed if the agent has a secret.
+	DownloadURL string `json:"download_url,omitempty"`
+
+	// QueuePosition is the 1-based position of the job in the queue, or 0
+	// if the job is not waiting to be run.
+	QueuePosition int `json:"queue_position,omitempty"`
+}
+
+// report records the status on the job and forwards it to the master.
+func (j *job) report(statusCode int, msg string) {
+	j.sendMu.Lock()
+	defer j.sendMu.Unlock()
+
+	j.mu.Lock()
+
+	now := time.Now()
+
+	if statusCode != j.status {
+		if phase, ok := phases[j.status]; ok {
+			phaseDuration.observe(now.Sub(j.phaseStarted).Seconds(), phase)
+		}
+
+		j.phaseStarted = now
+	}
+
+	j.status = statusCode
+	j.message = msg
+	j.updated = now
+
+	if statusCode >= status.ClientError {
+		j.lastError = msg
+	}
+
+	if isFinal(statusCode) {
+		j.finished = j.updated
+	}
+
+	j.mu.Unlock()
+
+	j.ch <- notif.Y{StatusCode: statusCode, Msg: msg}
+}
+
+// progress reports the progress of the current phase of the job. It is
+// dropped if the job has moved on to another phase in the meantime.
+func (j *job) progress(statusCode int, msg string) {
+	j.sendMu.Lock()
+	defer j.sendMu.Unlock()
+
+	j.mu.Lock()
+
+	if j.status != statusCode {
+		j.mu.Unlock()
+		return
+	}
+
+	j.message = msg
+	j.updated = time.Now()
+
+	j.mu.Unlock()
+
+	j.ch <- notif.Y{StatusCode: statusCode, Msg: msg}
+}
+
+// fail reports the failure of the job. If the job failed because it was
+// cancelled, the cancellation is reported instead, and the database of an
+// import or a copy is dropped as it is incomplete.
+func (j *job) fail(statusCode int, msg string) {
+	if !j.isCancelled() {
+		j.report(statusCode, msg)
+		return
+	}
+
+	if j.jobType == importJob || j.jobType == copyJob {
+		j.dropDatabase()
+	}
+
+	j.mu.RLock()
+	msg = j.cancelMsg
+	j.mu.RUnlock()
+
+	j.report(statusCancelled, msg)
+}
+
+// failAndDrop reports the failure of an import or a copy and drops its
+// incomplete database. A cancelled job has its database dropped by fail.
+func (j *job) failAndDrop(statusCode int, msg string) {
+	if !j.isCancelled() {
+		j.dropDatabase()
+	}
+
+	j.fail(statusCode, msg)
+}
+
+// dropDatabase drops the database of the job, if it was created for the job.
+// This is the only place the database of a failed or cancelled job is dropped.
+func (j *job) dropDatabase() {
+	j.mu.RLock()
+	owns := j.ownsDatabase
+	j.mu.RUnlock()
+
+	if !owns {
+		return
+	}
+
+	j.log().Info("Dropping database %q of job %d", j.req.DatabaseName, j.id)
+
+	err := db.DropDatabase(j.req.DBRequest)
+	if err != nil {
+		j.log().Error("could not drop database of job %d: %v", j.id, err)
+	}
+}
+
+// setOwnsDatabase records whether the database of the request was created for
+// the job, in the journal too.
+func (j *job) setOwnsDatabase(owns bool) {
+	j.mu.Lock()
+	j.ownsDatabase = owns
+	j.mu.Unlock()
+
+	activeJobs.ownDatabase(j, owns)
+}
+
+// abort cancels the job, which reports the cancellation with msg.
+func (j *job) abort(msg string) {
+	j.mu.Lock()
+	j.cancelMsg = msg
+	j.mu.Unlock()
+
+	j.cancel()
+}
+
+// send forwards the statuses of the job to the master, like notif does. Once
+// the channel of the job is closed and all were sent, the job is removed from
+// the journal and j.sent is closed.
+func (j *job) send(address string) {
+	defer close(j.sent)
+
+	for y := range j.ch {
+		_, err := notif.SndLoc(notif.Msg{ID: j.req.ID, StatusID: y.StatusCode, Message: y.Msg}, address)
+		if err != nil {
+			j.log().Error("could not report status %d to master: %v", y.StatusCode, err)
+		}
+	}
+
+	activeJobs.finish(j)
+	secrets.remove(j.req.Password)
+}
+
+// log returns a logger that adds the ID, the database and the current phase
+// of the job to the lines, along with the ID of the request that started it.
+func (j *job) log() fieldLogger {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	phase, ok := phases[j.status]
+	if !ok {
+		phase = strings.ToLower(status.Labels[j.status])
+	}
+
+	fields := []field{
+		{"job_id", j.id},
+		{"job_type", j.jobType},
+		{"database_name", j.req.DatabaseName},
+		{"phase", phase},
+	}
+
+	if j.requestID != "" {
+		fields = append(fields, field{"request_id", j.requestID})
+	}
+
+	return fieldLogger{fields: fields}
+}
+
+// exported records the file of a finished export.
+func (j *job) exported(filename string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.exportFile = filename
+}
+
+// isCancelled returns true if the job has been cancelled.
+func (j *job) isCancelled() bool {
+	return j.ctx.Err() != nil
+}
+
+// isDone returns true if the job has reached a final status.
+func (j *job) isDone() bool {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	return !j.finished.IsZero()
+}
+
+// done closes the notif channel of the job and releases its context. No
+// reports can be made afterwards.
+func (j *job) done() {
+	j.cancel()
+
+	j.mu.RLock()
+	outcome := "failure"
+	switch j.status {
+	case status.Success:
+		outcome = "success"
+	case statusCancelled:
+		outcome = "cancelled"
+	}
+	j.mu.RUnlock()
+
+	jobsTotal.inc(j.jobType, conf.Vendor, outcome)
+
+	close(j.ch)
+}
+
+// info returns the JSON representation of the job.
+func (j *job) info() JobInfo {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	req := j.req
+	if req.Password != "" {
+		req.Password = "****"
+	}
+
+	info := JobInfo{
+		ID:          j.id,
+		Type:        j.jobType,
+		Request:     req,
+		Status:      j.status,
+		StatusLabel: status.Labels[j.status],
+		Message:     j.message,
+		LastError:   j.lastError,
+		Created:     j.created,
+		Updated:     j.updated,
+	}
+
+	if !j.finished.IsZero() {
+		finished := j.finished
+		info.Finished = &finished
+	}
+
+	if j.exportFile != "" {
+		info.DownloadURL = exportURL(j.exportFile)
+	}
+
+	return info
+}
+
+// isFinal returns true if no more status updates are expected after the
+// status code.
+func isFinal(statusCode int) bool {
+	return statusCode == status.Success || statusCode >= status.ClientError
+}
+
+// jobRegistry holds the jobs of the agent. At most conf.MaxJobs jobs are
+// running at the same time, the rest wait in a first in, first out queue.
+type jobRegistry struct {
+	mu      sync.RWMutex
+	nextID  int
+	jobs    map[int]*job
+	running int
+	queue   []*job
+
+	// closed is set once the agent is shutting down.
+	closed bool
+}
+
+var jobs = &jobRegistry{jobs: make(map[int]*job)}
+
+// add registers a new job for the request and returns it. The ID of the HTTP
+// request that started the job is added to its log lines.
+func (r *jobRegistry) add(jobType string, req JobRequest, requestID string) *job {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.nextID++
+
+	now := time.Now()
+	upd8Path := fmt.Sprintf("%s/%s", conf.MasterAddress, "upd8")
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	j := &job{
+		ctx:       ctx,
+		cancel:    cancel,
+		id:        r.nextID,
+		jobType:   jobType,
+		req:       req,
+		requestID: requestID,
+		status:    status.Accepted,
+		message:   "Accepted",
+		created:   now,
+		updated:   now,
+		ch:        make(chan notif.Y),
+		sent:      make(chan struct{}),
+		cancelMsg: "Cancelled on request",
+		ready:     make(chan struct{}),
+
+		// The database of an import is created before the job is added.
+		ownsDatabase: jobType == importJob,
+	}
+
+	j.ctx = withLogger(withProgress(j.ctx, j.progress), j.log)
+
+	// The password is redacted from the log until the job is over.
+	secrets.add(req.Password)
+
+	go j.send(upd8Path)
+
+	r.jobs[j.id] = j
+
+	activeJobs.start(j)
+
+	// A job that slipped in while the agent started shutting down is
+	// cancelled right away.
+	if r.closed {
+		j.cancelMsg = shutdownMsg
+		j.cancel()
+	}
+
+	return j
+}
+
+// get returns the job with the given ID, or false if there's no such job.
+func (r *jobRegistry) get(id int) (*job, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	j, ok := r.jobs[id]
+
+	return j, ok
+}
+
+// info returns the JSON representation of the job, along with its position
+// in the queue.
+func (r *jobRegistry) info(j *job) JobInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	info := j.info()
+	info.QueuePosition = r.position(j)
+
+	return info
+}
+
+// list returns the information of all jobs, ordered by their IDs.
+func (r *jobRegistry) list() []JobInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	list := make([]JobInfo, 0, len(r.jobs))
+	for _, j := range r.jobs {
+		info := j.info()
+		info.QueuePosition = r.position(j)
+
+		list = append(list, info)
+	}
+
+	sort.Slice(list, func(i, k int) bool { return list[i].ID < list[k].ID })
+
+	return list
+}
+
+// prune removes the jobs that have finished more than maxAge ago.
+func (r *jobRegistry) prune(maxAge time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, j := range r.jobs {
+		info := j.info()
+		if info.Finished != nil && time.Since(*info.Finished) > maxAge {
+			delete(r.jobs, id)
+		}
+	}
+}
+
+// run runs the job once it gets its turn, then releases its place for the
+// next job in the queue. This method should always be called asynchronously
+func (r *jobRegistry) run(j *job, fn func(j *job)) {
+	defer j.done()
+
+	if j.isCancelled() || !r.wait(j) {
+		j.fail(status.ServerError, "Cancelled while queued")
+		return
+	}
+	defer r.release()
+
+	fn(j)
+}
+
+// wait blocks until the job is allowed to run. It returns false if the job
+// was cancelled while it was waiting in the queue.
+func (r *jobRegistry) wait(j *job) bool {
+	r.mu.Lock()
+
+	if len(r.queue) == 0 && r.running < conf.MaxJobs {
+		r.running++
+		r.mu.Unlock()
+
+		return true
+	}
+
+	r.queue = append(r.queue, j)
+	pos := len(r.queue)
+
+	r.mu.Unlock()
+
+	j.log().Info("Job %d is queued at position %d", j.id, pos)
+
+	j.report(statusQueued, fmt.Sprintf("Queued at position %d", pos))
+
+	select {
+	case <-j.ready:
+		return true
+	case <-j.ctx.Done():
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, q := range r.queue {
+		if q == j {
+			r.queue = append(r.queue[:i], r.queue[i+1:]...)
+			return false
+		}
+	}
+
+	// The job got its turn while it was being cancelled, so its place
+	// has to be handed over to the next one.
+	r.running--
+	r.next()
+
+	return false
+}
+
+// release frees up the place of a finished job and starts the next one.
+func (r *jobRegistry) release() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.running--
+	r.next()
+}
+
+// next starts the first job of the queue if there's a free place for it.
+// The caller must hold the lock of the registry.
+func (r *jobRegistry) next() {
+	if len(r.queue) == 0 || r.running >= conf.MaxJobs {
+		return
+	}
+
+	j := r.queue[0]
+	r.queue = r.queue[1:]
+
+	r.running++
+	close(j.ready)
+}
+
+// close stops the registry from running new jobs, and cancels the ones that
+// are waiting in the queue.
+func (r *jobRegistry) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.closed = true
+
+	for _, j := range r.queue {
+		j.abort(shutdownMsg)
+	}
+}
+
+// isClosed returns true if the agent is shutting down.
+func (r *jobRegistry) isClosed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.closed
+}
+
+// abortAll cancels all the jobs that are not done yet.
+func (r *jobRegistry) abortAll(msg string) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, j := range r.jobs {
+		if !j.isDone() {
+			j.abort(msg)
+		}
+	}
+}
+
+// drain waits until every job has finished and its last status has reached
+// the master, or until the timeout passes. It returns false on timeout.
+func (r *jobRegistry) drain(timeout time.Duration) bool {
+	r.mu.RLock()
+	pending := make([]*job, 0, len(r.jobs))
+	for _, j := range r.jobs {
+		pending = append(pending, j)
+	}
+	r.mu.RUnlock()
+
+	deadline := time.After(timeout)
+
+	for _, j := range pending {
+		select {
+		case <-j.sent:
+		case <-deadline:
+			return false
+		}
+	}
+
+	return true
+}
+
+// counts returns the number of the running and the queued jobs.
+func (r *jobRegistry) counts() (running, queued int) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.running, len(r.queue)
+}
+
+// position returns the 1-based position of the job in the queue, or 0 if
+// it's not queued. The caller must hold the lock of the registry.
+func (r *jobRegistry) position(j *job) int {
+	for i, q := range r.queue {
+		if q == j {
+			return i + 1
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/djavorszky/ddn-common/model"
+	"github.com/djavorszky/ddn-common/status"
+	"github.com/djavorszky/notif"
+	"github.com/gorilla/mux"
+)
+
+func TestJobQueue(t *testing.T) {
+	conf.MaxJobs = 1
+
+	r := &jobRegistry{jobs: make(map[int]*job)}
+
+	first := r.add(exportJob, JobRequest{DBRequest: model.DBRequest{DatabaseName: "first"}}, "")
+	second := r.add(exportJob, JobRequest{DBRequest: model.DBRequest{DatabaseName: "second"}}, "")
+
+	release := make(chan struct{})
+	started := make(chan string, 2)
+
+	fn := func(j *job) {
+		started <- j.req.DatabaseName
+		<-release
+	}
+
+	go r.run(first, fn)
+
+	if got := <-started; got != "first" {
+		t.Fatalf("Error; expected first job to start, got %q", got)
+	}
+
+	go r.run(second, fn)
+
+	deadline := time.Now().Add(time.Second)
+	for r.info(second).QueuePosition != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Error; second job should have been queued at position 1")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	release <- struct{}{}
+
+	if got := <-started; got != "second" {
+		t.Fatalf("Error; expected second job to start, got %q", got)
+	}
+
+	if pos := r.info(second).QueuePosition; pos != 0 {
+		t.Errorf("Error; running job should not have a queue position, got %d", pos)
+	}
+
+	release <- struct{}{}
+}
+
+func TestJobInfoRedactsPassword(t *testing.T) {
+	r := &jobRegistry{jobs: make(map[int]*job)}
+
+	j := r.add(importJob, JobRequest{DBRequest: model.DBRequest{DatabaseName: "db", Password: "secret"}}, "")
+	defer j.done()
+
+	if pw := r.info(j).Request.Password; pw == "secret" {
+		t.Errorf("Error; password should have been redacted, got %q", pw)
+	}
+}
+
+func TestJobRegistryDrain(t *testing.T) {
+	conf.MaxJobs = 1
+
+	r := &jobRegistry{jobs: make(map[int]*job)}
+
+	running := r.add(exportJob, JobRequest{DBRequest: model.DBRequest{DatabaseName: "running"}}, "")
+	queued := r.add(exportJob, JobRequest{DBRequest: model.DBRequest{DatabaseName: "queued"}}, "")
+
+	started := make(chan struct{})
+	go r.run(running, func(j *job) {
+		close(started)
+		<-j.ctx.Done()
+		j.fail(status.ExportFailed, "could not export database")
+	})
+	<-started
+
+	go r.run(queued, func(j *job) {
+		t.Errorf("Error; queued job should not run after shutdown")
+	})
+
+	deadline := time.Now().Add(time.Second)
+	for r.info(queued).QueuePosition != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Error; second job should have been queued at position 1")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	r.close()
+
+	if r.drain(50 * time.Millisecond) {
+		t.Fatalf("Error; drain should time out while a job is running")
+	}
+
+	if info := r.info(queued); info.Status != statusCancelled || info.Message != shutdownMsg {
+		t.Errorf("Error; queued job should be cancelled on shutdown, got %d %q", info.Status, info.Message)
+	}
+
+	r.abortAll(shutdownMsg)
+
+	if !r.drain(time.Second) {
+		t.Fatalf("Error; drain should finish once the jobs are cancelled")
+	}
+
+	if info := r.info(running); info.Status != statusCancelled {
+		t.Errorf("Error; running job should be cancelled, got %d", info.Status)
+	}
+
+	late := r.add(exportJob, JobRequest{DBRequest: model.DBRequest{DatabaseName: "late"}}, "")
+	if !late.isCancelled() {
+		t.Errorf("Error; job added after shutdown should be cancelled")
+	}
+	late.done()
+}
+
+func TestJobRegistryListAndGet(t *testing.T) {
+	r := &jobRegistry{jobs: make(map[int]*job)}
+
+	first := r.add(importJob, JobRequest{DBRequest: model.DBRequest{DatabaseName: "first"}}, "")
+	defer first.done()
+	second := r.add(exportJob, JobRequest{DBRequest: model.DBRequest{DatabaseName: "second"}}, "")
+	defer second.done()
+
+	list := r.list()
+	if len(list) != 2 {
+		t.Fatalf("Error; expected 2 jobs, got %d", len(list))
+	}
+
+	if list[0].ID != first.id || list[1].ID != second.id {
+		t.Errorf("Error; jobs should be listed by their IDs, got %d and %d", list[0].ID, list[1].ID)
+	}
+
+	if list[0].Type != importJob || list[0].Request.DatabaseName != "first" || list[0].Status != status.Accepted {
+		t.Errorf("Error; unexpected info of the first job: %+v", list[0])
+	}
+
+	if j, ok := r.get(second.id); !ok || j != second {
+		t.Errorf("Error; expected to get the second job")
+	}
+
+	if _, ok := r.get(42); ok {
+		t.Errorf("Error; job 42 should not exist")
+	}
+}
+
+func TestGetJobHandler(t *testing.T) {
+	registry := jobs
+	defer func() { jobs = registry }()
+
+	jobs = &jobRegistry{jobs: make(map[int]*job)}
+
+	j := jobs.add(exportJob, JobRequest{DBRequest: model.DBRequest{DatabaseName: "db"}}, "")
+	defer j.done()
+
+	tests := []struct {
+		id   string
+		code int
+	}{
+		{strconv.Itoa(j.id), http.StatusOK},
+		{"42", http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		req := mux.SetURLVars(httptest.NewRequest("GET", "/jobs/"+test.id, nil), map[string]string{"id": test.id})
+		rec := httptest.NewRecorder()
+
+		getJob(rec, req)
+
+		if rec.Code != test.code {
+			t.Errorf("Error; GET /jobs/%s returned %d, expected %d", test.id, rec.Code, test.code)
+		}
+	}
+}
+
+// fakeMaster records the statuses the agent reports to the master.
+type fakeMaster struct {
+	mu   sync.Mutex
+	msgs []notif.Msg
+}
+
+// startFakeMaster points the agent to a fake master, and returns it along
+// with a function that stops it.
+func startFakeMaster() (*fakeMaster, func()) {
+	m := &fakeMaster{}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg notif.Msg
+		json.NewDecoder(r.Body).Decode(&msg)
+
+		m.mu.Lock()
+		m.msgs = append(m.msgs, msg)
+		m.mu.Unlock()
+	}))
+
+	address := conf.MasterAddress
+	conf.MasterAddress = srv.URL
+
+	return m, func() {
+		conf.MasterAddress = address
+		srv.Close()
+	}
+}
+
+// useMaxJobs sets how many jobs may run at the same time, and returns a
+// function that restores it.
+func useMaxJobs(n int) func() {
+	old := conf.MaxJobs
+	conf.MaxJobs = n
+
+	return func() { conf.MaxJobs = old }
+}
+
+// count returns how many times the status was reported.
+func (m *fakeMaster) count(statusCode int) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var n int
+	for _, msg := range m.msgs {
+		if msg.StatusID == statusCode {
+			n++
+		}
+	}
+
+	return n
+}
+
+func TestCancelJob(t *testing.T) {
+	conf.MaxJobs = 1
+
+	master, stop := startFakeMaster()
+	defer stop()
+
+	stub := &stubDB{}
+	defer useDB(stub)()
+
+	registry := jobs
+	defer func() { jobs = registry }()
+
+	jobs = &jobRegistry{jobs: make(map[int]*job)}
+
+	j := jobs.add(importJob, JobRequest{DBRequest: model.DBRequest{DatabaseName: "db"}}, "")
+
+	started := make(chan struct{})
+	go jobs.run(j, func(j *job) {
+		close(started)
+		<-j.ctx.Done()
+		j.failAndDrop(status.ImportFailed, "Importing dump failed: killed")
+	})
+	<-started
+
+	cancel := func() int {
+		id := strconv.Itoa(j.id)
+		req := mux.SetURLVars(httptest.NewRequest("DELETE", "/jobs/"+id, nil), map[string]string{"id": id})
+		rec := httptest.NewRecorder()
+
+		cancelJob(rec, req)
+
+		return rec.Code
+	}
+
+	if code := cancel(); code != http.StatusOK {
+		t.Fatalf("Error; cancelling a running job returned %d", code)
+	}
+
+	select {
+	case <-j.sent:
+	case <-time.After(time.Second):
+		t.Fatalf("Error; cancelled job did not finish")
+	}
+
+	if !j.isCancelled() {
+		t.Errorf("Error; context of the job should be cancelled")
+	}
+
+	if n := master.count(statusCancelled); n != 1 {
+		t.Errorf("Error; cancellation should be reported once, got %d", n)
+	}
+
+	if n := master.count(status.ImportFailed); n != 0 {
+		t.Errorf("Error; failure of a cancelled job should not be reported, got %d", n)
+	}
+
+	if drops := stub.drops(); len(drops) != 1 {
+		t.Errorf("Error; database of the cancelled import should be dropped once, got %v", drops)
+	}
+
+	if code := cancel(); code != http.StatusConflict {
+		t.Errorf("Error; cancelling a finished job returned %d, expected %d", code, http.StatusConflict)
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/djavorszky/ddn-common/logger"
+	"github.com/djavorszky/ddn-common/model"
+	"github.com/djavorszky/ddn-common/status"
+	"github.com/djavorszky/notif"
+)
+
+// journalFile is the name of the journal in the working directory.
+const journalFile = "jobs.journal"
+
+// interruptedMsg is reported for the jobs that were interrupted by the agent
+// stopping unexpectedly.
+const interruptedMsg = "Interrupted, the agent stopped while the job was running"
+
+// journalEntry is a job that has not reported its final status yet, along
+// with what it leaves behind if the agent stops during it.
+type journalEntry struct {
+	// ID is the ID of the job at the master.
+	ID           int       `json:"id"`
+	Type         string    `json:"type"`
+	DatabaseName string    `json:"database_name"`
+	Username     string    `json:"username,omitempty"`
+	Files        []string  `json:"files,omitempty"`
+	Started      time.Time `json:"started"`
+
+	// OwnsDatabase is set if the database was created for the job, e.g. the
+	// database of a copy once it started. Only these are dropped.
+	OwnsDatabase bool `json:"owns_database,omitempty"`
+
+	// Cleaned is set once the leftovers of an interrupted job are removed,
+	// but its failure could not be reported to the master yet.
+	Cleaned bool `json:"cleaned,omitempty"`
+}
+
+// journal keeps track of the active jobs on the disk, so that the ones that
+// were interrupted can be cleaned up when the agent starts again.
+type journal struct {
+	mu   sync.Mutex
+	path string
+
+	// active are the entries of the jobs of this run, by their IDs.
+	active map[int]*journalEntry
+
+	// interrupted are the entries of the previous runs that are not yet
+	// reported to the master.
+	interrupted []*journalEntry
+}
+
+// activeJobs is the journal of the agent. It is not written until its path is
+// set on startup.
+var activeJobs = &journal{active: make(map[int]*journalEntry)}
+
+// start records the job as active.
+func (jl *journal) start(j *job) {
+	jl.mu.Lock()
+	defer jl.mu.Unlock()
+
+	jl.active[j.id] = &journalEntry{
+		ID:           j.req.ID,
+		Type:         j.jobType,
+		DatabaseName: j.req.DatabaseName,
+		Username:     j.req.Username,
+		Started:      j.created,
+		OwnsDatabase: j.ownsDatabase,
+	}
+
+	jl.save()
+}
+
+// ownDatabase records whether the database of the request was created for the
+// job, which decides if it's dropped when the job is interrupted.
+func (jl *journal) ownDatabase(j *job, owns bool) {
+	jl.mu.Lock()
+	defer jl.mu.Unlock()
+
+	e, ok := jl.active[j.id]
+	if !ok || e.OwnsDatabase == owns {
+		return
+	}
+
+	e.OwnsDatabase = owns
+
+	jl.save()
+}
+
+// stage records the files the job writes, which are removed if the agent
+// stops during the job.
+func (jl *journal) stage(j *job, files ...string) {
+	jl.mu.Lock()
+	defer jl.mu.Unlock()
+
+	e, ok := jl.active[j.id]
+	if !ok {
+		return
+	}
+
+	for _, file := range files {
+		if abs, err := filepath.Abs(file); err == nil {
+			file = abs
+		}
+
+		e.Files = append(e.Files, file)
+	}
+
+	jl.save()
+}
+
+// finish removes the job from the journal once its final status reached the
+// master.
+func (jl *journal) finish(j *job) {
+	jl.mu.Lock()
+	defer jl.mu.Unlock()
+
+	if _, ok := jl.active[j.id]; !ok {
+		return
+	}
+
+	delete(jl.active, j.id)
+
+	jl.save()
+}
+
+// save writes the journal to the disk. The caller must hold the lock of the
+// journal.
+func (jl *journal) save() {
+	if jl.path == "" {
+		return
+	}
+
+	entries := append([]*journalEntry{}, jl.interrupted...)
+
+	ids := make([]int, 0, len(jl.active))
+	for id := range jl.active {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		entries = append(entries, jl.active[id])
+	}
+
+	if err := writeJournal(jl.path, entries); err != nil {
+		logger.Error("could not write journal: %v", err)
+	}
+}
+
+// writeJournal replaces the journal at path with the entries. The journal is
+// written to a temporary file first, so that it's never left half written.
+func writeJournal(path string, entries []*journalEntry) error {
+	if len(entries) == 0 {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("removing journal failed: %s", err.Error())
+		}
+
+		return nil
+	}
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding journal failed: %s", err.Error())
+	}
+
+	tmp := path + ".tmp"
+
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return fmt.Errorf("writing journal failed: %s", err.Error())
+	}
+
+	err = os.Rename(tmp, path)
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("replacing journal failed: %s", err.Error())
+	}
+
+	return nil
+}
+
+// readJournal reads the entries of the journal at path. A missing journal
+// has no entries.
+func readJournal(path string) ([]*journalEntry, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading journal failed: %s", err.Error())
+	}
+
+	var entries []*journalEntry
+
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return nil, fmt.Errorf("decoding journal failed: %s", err.Error())
+	}
+
+	return entries, nil
+}
+
+// recoverJobs opens the journal at path and cleans up after the jobs that
+// were interrupted by the agent stopping: the databases created for imports
+// and copies are dropped, the staged files are removed, and the failure of the jobs is
+// reported to the master. Jobs whose failure can't be reported are kept in
+// the journal, and are reported by reportInterrupted or on the next start.
+func (jl *journal) recoverJobs(path string) error {
+	jl.mu.Lock()
+	defer jl.mu.Unlock()
+
+	// The jobs of this run are journaled even if the old journal is broken.
+	jl.path = path
+	jl.interrupted = nil
+
+	entries, err := readJournal(path)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if !e.Cleaned {
+			logger.Warn("Cleaning up %s job %d of database %q, interrupted since %s", e.Type, e.ID, e.DatabaseName, e.Started.Format(time.RFC3339))
+
+			e.clean()
+			e.Cleaned = true
+		}
+	}
+
+	jl.interrupted = entries
+	jl.report()
+
+	return nil
+}
+
+// reportInterrupted reports the failure of the interrupted jobs that could not
+// be reported to the master so far. It's called once the master is reachable
+// again.
+func (jl *journal) reportInterrupted() {
+	jl.mu.Lock()
+	defer jl.mu.Unlock()
+
+	if len(jl.interrupted) == 0 {
+		return
+	}
+
+	jl.report()
+}
+
+// report reports the failure of the interrupted jobs to the master, and keeps
+// the ones that could not be reported. The caller must hold the lock of the
+// journal.
+func (jl *journal) report() {
+	var unreported []*journalEntry
+
+	for _, e := range jl.interrupted {
+		err := e.reportFailure()
+		if err != nil {
+			logger.Error("could not report interrupted job %d to master, will retry once it's reachable: %v", e.ID, err)
+
+			unreported = append(unreported, e)
+		}
+	}
+
+	jl.interrupted = unreported
+
+	jl.save()
+}
+
+// clean drops the partial database of an interrupted import or copy, and
+// removes the files staged by the job. The database of a copy that was still
+// queued is left alone, as it belongs to someone else if it exists.
+func (e *journalEntry) clean() {
+	// Oracle schemas are identified by the user only.
+	if e.OwnsDatabase && (e.DatabaseName != "" || e.Username != "") {
+		name := e.DatabaseName
+		if name == "" {
+			name = e.Username
+		}
+
+		logger.Info("Dropping partial database %q", name)
+
+		err := db.DropDatabase(model.DBRequest{DatabaseName: e.DatabaseName, Username: e.Username})
+		if err != nil {
+			logger.Error("could not drop partial database %q: %v", name, err)
+		}
+	}
+
+	for _, file := range e.Files {
+		logger.Debug("Removing %s", file)
+
+		err := os.RemoveAll(file)
+		if err != nil {
+			logger.Error("could not remove %s: %v", file, err)
+		}
+	}
+}
+
+// reportFailure reports the failure of the interrupted job to the master.
+func (e *journalEntry) reportFailure() error {
+	statusCode := status.ServerError
+	switch e.Type {
+	case importJob:
+		statusCode = status.ImportFailed
+	case exportJob:
+		statusCode = status.ExportFailed
+	case copyJob:
+		statusCode = statusCopyFailed
+	}
+
+	upd8Path := fmt.Sprintf("%s/%s", conf.MasterAddress, "upd8")
+
+	_, err := notif.SndLoc(notif.Msg{ID: e.ID, StatusID: statusCode, Message: interruptedMsg}, upd8Path)
+
+	return err
+}
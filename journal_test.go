@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/djavorszky/ddn-common/model"
+	"github.com/djavorszky/ddn-common/status"
+	"github.com/djavorszky/notif"
+)
+
+func TestRecoverJobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ddn-journal")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	staged := filepath.Join(dir, "export.sql.gz")
+	ioutil.WriteFile(staged, []byte("partial"), 0600)
+
+	path := filepath.Join(dir, journalFile)
+	writeJournal(path, []*journalEntry{{ID: 42, Type: exportJob, DatabaseName: "db", Files: []string{staged}, Started: time.Now()}})
+
+	var got []notif.Msg
+	up := true
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		var msg notif.Msg
+		json.NewDecoder(r.Body).Decode(&msg)
+		got = append(got, msg)
+	}))
+	defer master.Close()
+
+	address := conf.MasterAddress
+	defer func() { conf.MasterAddress = address }()
+	conf.MasterAddress = master.URL
+
+	// The master is down, so the job stays in the journal, cleaned up.
+	up = false
+
+	jl := &journal{active: make(map[int]*journalEntry)}
+	if err := jl.recoverJobs(path); err != nil {
+		t.Fatalf("recoverJobs: %v", err)
+	}
+
+	if exists(staged) {
+		t.Errorf("Error; staged file of the interrupted job should have been removed")
+	}
+
+	entries, _ := readJournal(path)
+	if len(entries) != 1 || !entries[0].Cleaned {
+		t.Fatalf("Error; unreported job should be kept in the journal as cleaned, got %+v", entries)
+	}
+
+	// The master is back, so the job is reported without a restart.
+	up = true
+
+	jl.reportInterrupted()
+
+	if len(got) != 1 || got[0].ID != 42 || got[0].StatusID != status.ExportFailed {
+		t.Errorf("Error; expected export failure of job 42 to be reported, got %+v", got)
+	}
+
+	if exists(path) {
+		t.Errorf("Error; journal should be removed once every job is reported")
+	}
+}
+
+func TestRecoverJobsDropsOwnedDatabases(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ddn-journal")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, stop := startFakeMaster()
+	defer stop()
+
+	stub := &stubDB{}
+	defer useDB(stub)()
+
+	path := filepath.Join(dir, journalFile)
+	writeJournal(path, []*journalEntry{
+		{ID: 1, Type: importJob, DatabaseName: "imported", OwnsDatabase: true},
+		{ID: 2, Type: copyJob, DatabaseName: "copied", OwnsDatabase: true},
+		{ID: 3, Type: copyJob, DatabaseName: "queued"},
+		{ID: 4, Type: importJob, Username: "SCHEMA", OwnsDatabase: true},
+	})
+
+	jl := &journal{active: make(map[int]*journalEntry)}
+	if err := jl.recoverJobs(path); err != nil {
+		t.Fatalf("recoverJobs: %v", err)
+	}
+
+	if want := []string{"imported", "copied", "SCHEMA"}; !reflect.DeepEqual(stub.drops(), want) {
+		t.Errorf("Error; expected only the databases created for the jobs to be dropped %v, got %v", want, stub.drops())
+	}
+}
+
+func TestJournalOwnsDatabase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ddn-journal")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, stop := startFakeMaster()
+	defer stop()
+
+	defer useMaxJobs(1)()
+
+	stub := &stubDB{}
+	defer useDB(stub)()
+
+	old := activeJobs
+	defer func() { activeJobs = old }()
+
+	path := filepath.Join(dir, journalFile)
+
+	activeJobs = &journal{active: make(map[int]*journalEntry)}
+	activeJobs.recoverJobs(path)
+
+	r := &jobRegistry{jobs: make(map[int]*job)}
+	imp := r.add(importJob, JobRequest{DBRequest: model.DBRequest{ID: 1, DatabaseName: "imported"}}, "")
+	cp := r.add(copyJob, JobRequest{DBRequest: model.DBRequest{ID: 2, DatabaseName: "copied"}, SourceDatabase: "source"}, "")
+
+	owns := func() map[int]bool {
+		entries, _ := readJournal(path)
+
+		got := make(map[int]bool)
+		for _, e := range entries {
+			got[e.ID] = e.OwnsDatabase
+		}
+
+		return got
+	}
+
+	// The database of an import is created by the handler, the one of a
+	// queued copy may belong to someone else.
+	if got, want := owns(), map[int]bool{1: true, 2: false}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Error; expected the databases owned by the queued jobs to be %v, got %v", want, got)
+	}
+
+	started := make(chan struct{})
+	go r.run(cp, func(j *job) {
+		j.setOwnsDatabase(true)
+		close(started)
+		<-j.ctx.Done()
+		j.fail(statusCopyFailed, "Copy cancelled")
+	})
+	<-started
+
+	if got, want := owns(), map[int]bool{1: true, 2: true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Error; expected the databases owned by the started jobs to be %v, got %v", want, got)
+	}
+
+	cp.abort("Cancelled on request")
+	imp.abort("Cancelled on request")
+	go r.run(imp, startImport)
+
+	for _, j := range []*job{cp, imp} {
+		select {
+		case <-j.sent:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Error; job %d did not finish", j.id)
+		}
+	}
+
+	if exists(path) {
+		t.Errorf("Error; journal should be removed once every job is reported")
+	}
+}
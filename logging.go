@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/djavorszky/ddn-common/logger"
+)
+
+// The formats of the log.
+const (
+	logText = "text"
+	logJSON = "json"
+)
+
+// requestIDHeader is the header the ID of a request is read from and
+// returned in.
+const requestIDHeader = "X-Request-ID"
+
+// field is a key and a value that is added to a line of the log.
+type field struct {
+	key   string
+	value interface{}
+}
+
+// logWriter writes the lines of the log in the configured format. The lines
+// of ddn-common/logger reach it through the standard log package, the lines
+// with fields through a fieldLogger. Secrets are redacted from the messages of
+// both.
+type logWriter struct {
+	mu   sync.Mutex
+	out  io.Writer
+	json bool
+}
+
+// logOutput is where the log of the agent is written.
+var logOutput = &logWriter{out: os.Stderr}
+
+// setOutput changes where the log is written.
+func (lw *logWriter) setOutput(out io.Writer) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+
+	lw.out = out
+}
+
+// setFormat sets the format of the log, which is either text or json.
+func (lw *logWriter) setFormat(format string) error {
+	switch strings.ToLower(format) {
+	case "", logText:
+		lw.json = false
+	case logJSON:
+		lw.json = true
+	default:
+		return fmt.Errorf("unknown log format %q, should be text or json", format)
+	}
+
+	return nil
+}
+
+// Write writes a line of ddn-common/logger, which looks like "[level] msg".
+func (lw *logWriter) Write(p []byte) (int, error) {
+	line := strings.TrimSuffix(string(p), "\n")
+
+	level, msg := "", line
+	if strings.HasPrefix(line, "[") {
+		if i := strings.Index(line, "]"); i > 0 {
+			level, msg = line[1:i], strings.TrimLeft(line[i+1:], " ")
+		}
+	}
+
+	if err := lw.entry(level, msg, nil); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// entry writes a line of the log with the fields.
+func (lw *logWriter) entry(level, msg string, fields []field) error {
+	var buf bytes.Buffer
+
+	now := time.Now()
+	msg = secrets.redact(msg)
+
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+
+	if lw.json {
+		line := map[string]interface{}{
+			"time":  now.Format(time.RFC3339Nano),
+			"level": level,
+			"msg":   msg,
+		}
+
+		for _, f := range fields {
+			line[f.key] = f.value
+		}
+
+		if err := json.NewEncoder(&buf).Encode(line); err != nil {
+			return err
+		}
+	} else {
+		buf.WriteString(now.Format("2006/01/02 15:04:05 "))
+
+		if level != "" {
+			// The same padding as ddn-common/logger uses.
+			fmt.Fprintf(&buf, "%-8s", "["+level+"]")
+		}
+
+		buf.WriteString(msg)
+
+		for _, f := range fields {
+			fmt.Fprintf(&buf, " %s=%v", f.key, f.value)
+		}
+
+		buf.WriteByte('\n')
+	}
+
+	_, err := io.WriteString(lw.out, buf.String())
+
+	return err
+}
+
+// fieldLogger logs lines with fields, at the levels of ddn-common/logger.
+type fieldLogger struct {
+	fields []field
+}
+
+func (fl fieldLogger) log(level logger.LogLevel, msg string, args ...interface{}) {
+	if logger.Level&level != logger.Level {
+		return
+	}
+
+	logOutput.entry(level.String(), fmt.Sprintf(msg, args...), fl.fields)
+}
+
+// Error should be used for application errors that should be resolved
+func (fl fieldLogger) Error(msg string, args ...interface{}) {
+	fl.log(logger.ERROR, msg, args...)
+}
+
+// Warn should be used for events that can be dangerous
+func (fl fieldLogger) Warn(msg string, args ...interface{}) {
+	fl.log(logger.WARN, msg, args...)
+}
+
+// Info should be used to share data.
+func (fl fieldLogger) Info(msg string, args ...interface{}) {
+	fl.log(logger.INFO, msg, args...)
+}
+
+// Debug should be used for debugging purposes only.
+func (fl fieldLogger) Debug(msg string, args ...interface{}) {
+	fl.log(logger.DEBUG, msg, args...)
+}
+
+type loggerKey struct{}
+
+// withLogger returns a context that carries fn, which returns the logger of a
+// job with its current fields. The helpers a job calls log through it, so that
+// their lines can be told apart by job too.
+func withLogger(ctx context.Context, fn func() fieldLogger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, fn)
+}
+
+// logFor returns the logger carried by the context, or a logger without fields
+// if it carries none.
+func logFor(ctx context.Context) fieldLogger {
+	if fn, ok := ctx.Value(loggerKey{}).(func() fieldLogger); ok {
+		return fn()
+	}
+
+	return fieldLogger{}
+}
+
+type requestIDKey struct{}
+
+// withRequestID assigns an ID to every request, or takes it from the
+// X-Request-ID header, and returns it in the same header.
+func withRequestID(inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" || len(id) > 128 {
+			id = newRequestID()
+		}
+
+		w.Header().Set(requestIDHeader, id)
+
+		inner.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// requestID returns the ID of the request.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+
+	return id
+}
+
+// logRequest logs the requests to inner along with their IDs, like the Logger
+// of ddn-common/srv does.
+func logRequest(inner http.Handler, name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		inner.ServeHTTP(w, r)
+
+		if strings.HasPrefix(r.RequestURI, "/alive") || r.RequestURI == "/heartbeat" {
+			return
+		}
+
+		fl := fieldLogger{fields: []field{{"request_id", requestID(r)}, {"route", name}}}
+		fl.Debug("[%s]\t%s\t%s\t%s\t", r.RemoteAddr, r.Method, r.RequestURI, time.Since(start))
+	})
+}
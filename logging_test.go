@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/djavorszky/ddn-common/logger"
+	"github.com/djavorszky/ddn-common/model"
+	"github.com/djavorszky/ddn-common/status"
+)
+
+func TestJSONLogFields(t *testing.T) {
+	var buf bytes.Buffer
+
+	out := logOutput
+	defer func() { logOutput = out }()
+
+	logOutput = &logWriter{out: &buf}
+	if err := logOutput.setFormat("json"); err != nil {
+		t.Fatalf("setFormat: %v", err)
+	}
+
+	lvl := logger.Level
+	defer func() { logger.Level = lvl }()
+	logger.Level = logger.DEBUG
+
+	j := &job{id: 7, jobType: importJob, requestID: "abc123", status: status.ImportInProgress,
+		req: JobRequest{DBRequest: model.DBRequest{DatabaseName: "db"}}}
+	j.log().Debug("Importing dump: %v", "dump.sql")
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("log line %q is not JSON: %v", buf.String(), err)
+	}
+
+	want := map[string]interface{}{
+		"level":         "debug",
+		"msg":           "Importing dump: dump.sql",
+		"job_id":        float64(7),
+		"database_name": "db",
+		"phase":         "import",
+		"request_id":    "abc123",
+	}
+
+	for k, v := range want {
+		if line[k] != v {
+			t.Errorf("%s = %v, want %v", k, line[k], v)
+		}
+	}
+
+	// The helpers of the job log with its fields through its context.
+	buf.Reset()
+	logFor(withLogger(context.Background(), j.log)).Warn("Retrying download")
+
+	line = nil
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("log line %q is not JSON: %v", buf.String(), err)
+	}
+
+	if line["job_id"] != float64(7) || line["phase"] != "import" {
+		t.Errorf("line logged through the context = %v, want the fields of the job", line)
+	}
+
+	buf.Reset()
+	log.New(logOutput, "", 0).Print("[warn]  Master server unreachable")
+
+	line = nil
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("log line %q is not JSON: %v", buf.String(), err)
+	}
+
+	if line["level"] != "warn" || line["msg"] != "Master server unreachable" {
+		t.Errorf("logger line = %v, want level warn and the message", line)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var got string
+	handler := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = requestID(r)
+	}))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(requestIDHeader, "from-master")
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if got != "from-master" || rec.Header().Get(requestIDHeader) != "from-master" {
+		t.Errorf("request ID = %q, header %q, want from-master", got, rec.Header().Get(requestIDHeader))
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if len(got) != 16 {
+		t.Errorf("generated request ID = %q, want 16 hex characters", got)
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"flag"
 	"fmt"
 	"log"
-	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -35,7 +34,12 @@ func main() {
 	defer func() {
 		if p := recover(); p != nil {
 			logger.Error("Panic... Unregistering")
-			unregisterAgent()
+
+			if err := unregisterAgent(); err != nil {
+				logger.Error("couldn't unregister from master: %v", err)
+			}
+
+			os.Exit(1)
 		}
 	}()
 
@@ -43,8 +47,33 @@ func main() {
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
-		unregisterAgent()
-		os.Exit(1)
+
+		// A second signal stops the agent without waiting for the jobs.
+		go func() {
+			<-c
+			logger.Warn("Received second signal, exiting without waiting for the jobs")
+			os.Exit(1)
+		}()
+
+		shutdown()
+	}()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			logger.Info("Received SIGHUP, reloading certificates and reopening the log file")
+			reloadCertificates()
+
+			if logFile != nil {
+				if err := logFile.reopen(); err != nil {
+					fmt.Fprintf(os.Stderr, "reopening log file failed, logging to stderr: %s\n", err.Error())
+					logOutput.setOutput(os.Stderr)
+				} else {
+					logOutput.setOutput(logFile)
+				}
+			}
+		}
 	}()
 
 	var err error
@@ -58,6 +87,19 @@ func main() {
 		logger.Fatal("Failed loading configuration: %v", err)
 	}
 
+	// Passwords are removed from the log lines, wherever they end up.
+	secrets.add(conf.Password)
+	secrets.add(conf.SysPassword)
+	secrets.add(conf.Secret)
+
+	log.SetFlags(0)
+	log.SetOutput(logOutput)
+
+	err = logOutput.setFormat(conf.LogFormat)
+	if err != nil {
+		logger.Fatal("Invalid log format: %v", err)
+	}
+
 	logLevel, err := logger.Parse(conf.LogLevel)
 	if err != nil {
 		logLevel = logger.INFO
@@ -65,26 +107,51 @@ func main() {
 
 	logger.Level = logLevel
 
+	if conf.MaxJobs <= 0 {
+		conf.MaxJobs = defaultMaxJobs
+	}
+
+	err = setupMasterTLS()
+	if err != nil {
+		logger.Fatal("Failed setting up TLS to the master: %v", err)
+	}
+
+	if conf.Secret == "" {
+		logger.Warn("No agent-secret is configured, the API of the agent is open to anyone")
+	}
+
+	if conf.MaxExtractedSize <= 0 {
+		conf.MaxExtractedSize = defaultMaxExtractedSize
+	}
+
+	if conf.MaxCompressionRatio <= 0 {
+		conf.MaxCompressionRatio = defaultMaxCompressionRatio
+	}
+
+	checkDecompressCommands()
+	checkCompressCommands()
+
 	if _, err := os.Stat(conf.Exec); os.IsNotExist(err) {
 		logger.Fatal("database executable doesn't exist: %v", conf.Exec)
 	}
 
 	if *logname != "std" {
-		if _, err := os.Stat(*logname); err == nil {
-			rotated := fmt.Sprintf("%s.%s", *logname, time.Now().Format("2006-01-02_03:04"))
-			logger.Debug("Rotating logfile to %s", rotated)
-
-			os.Rename(*logname, rotated)
+		var maxAge time.Duration
+		if conf.LogMaxAge != "" {
+			maxAge, err = time.ParseDuration(conf.LogMaxAge)
+			if err != nil {
+				logger.Fatal("Invalid log max age: %v", conf.LogMaxAge)
+			}
 		}
 
-		logOut, err := os.OpenFile(*logname, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+		logFile, err = openRotatingFile(*logname, conf.LogMaxSize*1024*1024, maxAge, conf.LogMaxFiles, conf.LogCompress)
 		if err != nil {
 			fmt.Printf("error opening file %s, will continue logging to stderr: %s", *logname, err.Error())
-			logOut = os.Stderr
-		}
-		defer logOut.Close()
+		} else {
+			defer logFile.Close()
 
-		log.SetOutput(logOut)
+			logOutput.setOutput(logFile)
+		}
 	}
 
 	hostname, err = os.Hostname()
@@ -102,6 +169,13 @@ func main() {
 	logger.Info("Starting with properties:")
 	conf.Print()
 
+	if conf.ShutdownTimeout != "" {
+		shutdownTimeout, err = time.ParseDuration(conf.ShutdownTimeout)
+		if err != nil {
+			logger.Fatal("Invalid shutdown timeout: %v", conf.ShutdownTimeout)
+		}
+	}
+
 	if conf.StartupDelay != "" {
 		d, err := time.ParseDuration(conf.StartupDelay)
 		if err != nil {
@@ -131,6 +205,11 @@ func main() {
 		conf.Version = ver
 	}
 
+	err = validateOptions(DatabaseOptions{}.withDefaults())
+	if err != nil {
+		logger.Fatal("Invalid default database options: %v", err)
+	}
+
 	workdir, err = os.Getwd()
 	if err != nil {
 		logger.Fatal("could not determine current directory")
@@ -173,6 +252,12 @@ func main() {
 		}
 	}
 
+	// Clean up after the jobs that were running when the agent last stopped.
+	err = activeJobs.recoverJobs(filepath.Join(workdir, journalFile))
+	if err != nil {
+		logger.Error("Could not recover interrupted jobs: %v", err)
+	}
+
 	err = registerAgent()
 	if err != nil {
 		logger.Error("Could not register agent, will keep trying: %s", err.Error())
@@ -180,6 +265,7 @@ func main() {
 
 	go keepAlive()
 	go checkExports()
+	go pruneJobs()
 
 	sl := strings.Split(conf.AgentAddr, ":")
 
@@ -187,13 +273,17 @@ func main() {
 
 	logger.Info("Starting to listen on %s", conf.AgentAddr)
 
+	if conf.TLSCert != "" && !strings.HasPrefix(conf.AgentAddr, "https://") {
+		logger.Warn("Serving HTTPS, but the agent-addr %q is not an https:// address", conf.AgentAddr)
+	}
+
 	port = fmt.Sprintf(":%s", port)
 
 	startup = time.Now()
 
 	logger.Debug("Started up at %s", startup.Round(time.Millisecond))
 
-	logger.Fatal("server: %v", http.ListenAndServe(port, Router()))
+	logger.Fatal("server: %v", listenAndServe(port, Router()))
 }
 
 func loadProperties(confLocation string) error {
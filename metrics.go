@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The metrics of the agent, served at /metrics in the text format of
+// Prometheus.
+var (
+	jobsTotal = newCounterVec("ddn_agent_jobs_total",
+		"Finished jobs by type, vendor and outcome.", "type", "vendor", "outcome")
+
+	phaseDuration = newHistogramVec("ddn_agent_phase_duration_seconds",
+		"Duration of the phases of the jobs.",
+		[]float64{1, 5, 15, 30, 60, 300, 900, 1800, 3600, 7200, 21600}, "phase")
+
+	downloadedBytes = newCounterVec("ddn_agent_downloaded_bytes_total",
+		"Bytes of dumps downloaded.")
+
+	aliveFailures = newCounterVec("ddn_agent_db_alive_failures_total",
+		"Failed alive checks of the database.")
+
+	agentRegistered = newGauge("ddn_agent_registered",
+		"Whether the agent is registered with the master server.")
+
+	jobsInFlight = newGaugeFunc("ddn_agent_jobs_in_flight",
+		"Jobs that are running.", func() float64 {
+			running, _ := jobs.counts()
+			return float64(running)
+		})
+
+	jobsQueued = newGaugeFunc("ddn_agent_jobs_queued",
+		"Jobs that wait for their turn to run.", func() float64 {
+			_, queued := jobs.counts()
+			return float64(queued)
+		})
+
+	httpDuration = newHistogramVec("ddn_agent_http_request_duration_seconds",
+		"Latency of the HTTP requests by route, method and status code.",
+		[]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}, "route", "method", "code")
+)
+
+// metric is a metric that can be written in the text format.
+type metric interface {
+	write(w io.Writer)
+}
+
+var allMetrics = []metric{
+	jobsTotal,
+	phaseDuration,
+	downloadedBytes,
+	aliveFailures,
+	agentRegistered,
+	jobsInFlight,
+	jobsQueued,
+	httpDuration,
+}
+
+// metricsHandler serves the metrics.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	for _, m := range allMetrics {
+		m.write(w)
+	}
+}
+
+// counterVec is a counter with a value for each set of its labels.
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+// add adds v to the value of the labels, which are given in the order of the
+// names of the labels.
+func (c *counterVec) add(v float64, labels ...string) {
+	key := labelString(c.labels, labels)
+
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+func (c *counterVec) inc(labels ...string) {
+	c.add(1, labels...)
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	writeHeader(w, c.name, c.help, "counter")
+
+	// A counter without labels is always present.
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", c.name)
+		return
+	}
+
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, key, formatValue(c.values[key]))
+	}
+}
+
+// gauge is a value that can go up and down.
+type gauge struct {
+	name, help string
+	bits       uint64
+}
+
+func newGauge(name, help string) *gauge {
+	return &gauge{name: name, help: help}
+}
+
+func (g *gauge) set(v float64) {
+	atomic.StoreUint64(&g.bits, math.Float64bits(v))
+}
+
+func (g *gauge) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatValue(math.Float64frombits(atomic.LoadUint64(&g.bits))))
+}
+
+// gaugeFunc is a gauge whose value is taken when the metrics are written.
+type gaugeFunc struct {
+	name, help string
+	value      func() float64
+}
+
+func newGaugeFunc(name, help string, value func() float64) *gaugeFunc {
+	return &gaugeFunc{name: name, help: help, value: value}
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatValue(g.value()))
+}
+
+// histogramVec counts observations in buckets, for each set of its labels.
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	labels []string
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogram)}
+}
+
+// observe records v for the labels, which are given in the order of the names
+// of the labels.
+func (h *histogramVec) observe(v float64, labels ...string) {
+	key := labelString(h.labels, labels)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{labels: labels, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+		}
+	}
+
+	s.sum += v
+	s.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	names := append(append([]string{}, h.labels...), "le")
+
+	for _, key := range keys {
+		s := h.series[key]
+
+		for i, upper := range h.buckets {
+			le := labelString(names, append(append([]string{}, s.labels...), formatValue(upper)))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, le, s.counts[i])
+		}
+
+		inf := labelString(names, append(append([]string{}, s.labels...), "+Inf"))
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, inf, s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, key, formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, key, s.count)
+	}
+}
+
+// statusRecorder records the status code of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	sr.code = code
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+// instrument records the latency of the requests to inner in httpDuration.
+func instrument(inner http.Handler, name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+
+		inner.ServeHTTP(sr, r)
+
+		httpDuration.observe(time.Since(start).Seconds(), name, r.Method, strconv.Itoa(sr.code))
+	})
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// labelString returns the labels in the form of {name="value",...}, or an
+// empty string if there are none.
+func labelString(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		var value string
+		if i < len(values) {
+			value = values[i]
+		}
+
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(value))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCounterVec(t *testing.T) {
+	c := newCounterVec("test_total", "Test counter.", "type", "outcome")
+	c.inc("import", "success")
+	c.inc("import", "success")
+	c.add(0.5, "export", `fa"il`)
+
+	var buf bytes.Buffer
+	c.write(&buf)
+
+	want := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{type="export",outcome="fa\"il"} 0.5
+test_total{type="import",outcome="success"} 2
+`
+	if buf.String() != want {
+		t.Errorf("counter output:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	h := newHistogramVec("test_seconds", "Test histogram.", []float64{1, 5}, "phase")
+	h.observe(0.5, "download")
+	h.observe(3, "download")
+	h.observe(10, "download")
+
+	var buf bytes.Buffer
+	h.write(&buf)
+
+	for _, line := range []string{
+		`test_seconds_bucket{phase="download",le="1"} 1`,
+		`test_seconds_bucket{phase="download",le="5"} 2`,
+		`test_seconds_bucket{phase="download",le="+Inf"} 3`,
+		`test_seconds_sum{phase="download"} 13.5`,
+		`test_seconds_count{phase="download"} 3`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("histogram output is missing %q:\n%s", line, buf.String())
+		}
+	}
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/djavorszky/ddn-common/logger"
 	"github.com/djavorszky/ddn-common/model"
@@ -19,6 +22,7 @@ type mssql struct {
 var (
 	mssqlCreateUserQueryTmpl string
 	mssqlImportQueryTmpl     string
+	mssqlExportQueryTmpl     string
 )
 
 func init() {
@@ -40,6 +44,13 @@ func init() {
 	}
 
 	mssqlCreateUserQueryTmpl = string(b)
+
+	b, err = ioutil.ReadFile(curDir + "/sql/mssql/export_dump.sql")
+	if err != nil {
+		panic("failed reading export procedure for mssql")
+	}
+
+	mssqlExportQueryTmpl = string(b)
 }
 
 func (db *mssql) Connect(c Config) error {
@@ -52,17 +63,14 @@ func (db *mssql) Connect(c Config) error {
 }
 
 func (db *mssql) createUser(username, password string) error {
-	connectArgs := db.getConnectArg()
-
 	// sqlcmd on Linux does not support passing variables on the commandline, so we need to work it around.
 	query := mssqlCreateUserQueryTmpl
 
-	query = strings.Replace(query, "$(name)", username, -1)
-	query = strings.Replace(query, "$(password)", password, -1)
-
-	args := append(connectArgs, "-Q", query)
+	query = strings.Replace(query, "$(nameLiteral)", quoteMSSQLLiteral(username), -1)
+	query = strings.Replace(query, "$(name)", quoteMSSQLIdentifier(username), -1)
+	query = strings.Replace(query, "$(password)", quoteMSSQLLiteral(password), -1)
 
-	res := RunCommand(conf.Exec, args...)
+	res := db.sqlcmd(context.Background(), conf.User, conf.Password, query)
 	if res.exitCode != 0 {
 		logger.Error("unable to create user:\n> stdout:\n%q\n> stderr:\n%q\n> exitCode: %d", res.stdout, res.stderr, res.exitCode)
 
@@ -87,15 +95,13 @@ func (db *mssql) CreateDatabase(dbRequest model.DBRequest) error {
 		return fmt.Errorf("create database: %v", err)
 	}
 
-	connectArgs := db.getConnectSlice(dbRequest.Username, dbRequest.Password)
-
-	args := append(connectArgs, "-Q", fmt.Sprintf("CREATE DATABASE %s", dbRequest.DatabaseName))
+	query := fmt.Sprintf("CREATE DATABASE %s", quoteMSSQLIdentifier(dbRequest.DatabaseName))
 
-	res := RunCommand(conf.Exec, args...)
+	res := db.sqlcmd(context.Background(), dbRequest.Username, dbRequest.Password, query)
 
 	if res.exitCode != 0 {
 		if strings.Contains(res.stderr, "already exists") {
-			return fmt.Errorf("database %q already exists", dbRequest.DatabaseName)
+			return fmt.Errorf("database %q %w", dbRequest.DatabaseName, errTargetExists)
 		}
 		logger.Error("unable to create database:\n> stdout:\n%q\n> stderr:\n%q\n> exitCode: %d", res.stdout, res.stderr, res.exitCode)
 
@@ -106,11 +112,9 @@ func (db *mssql) CreateDatabase(dbRequest model.DBRequest) error {
 }
 
 func (db *mssql) DropDatabase(dbRequest model.DBRequest) error {
-	connectArgs := db.getConnectArg()
+	query := fmt.Sprintf("DROP DATABASE %s", quoteMSSQLIdentifier(dbRequest.DatabaseName))
 
-	args := append(connectArgs, "-Q", fmt.Sprintf("DROP DATABASE %s", dbRequest.DatabaseName))
-
-	res := RunCommand(conf.Exec, args...)
+	res := db.sqlcmd(context.Background(), conf.User, conf.Password, query)
 
 	if res.exitCode != 0 {
 		if !(strings.Contains(res.stderr, "it does not exist")) {
@@ -123,48 +127,108 @@ func (db *mssql) DropDatabase(dbRequest model.DBRequest) error {
 	return nil
 }
 
-func (db *mssql) ImportDatabase(dbRequest model.DBRequest) error {
-	connectArgs := db.getConnectSlice(dbRequest.Username, dbRequest.Password)
-
+func (db *mssql) ImportDatabase(ctx context.Context, dbRequest model.DBRequest) error {
 	query := mssqlImportQueryTmpl
 
-	query = strings.Replace(query, "$(dumpPath)", dbRequest.DumpLocation, -1)
-	query = strings.Replace(query, "$(targetDatabaseName)", dbRequest.DatabaseName, -1)
+	query = strings.Replace(query, "$(dumpPath)", quoteMSSQLLiteral(dbRequest.DumpLocation), -1)
+	query = strings.Replace(query, "$(targetDatabaseName)", quoteMSSQLLiteral(dbRequest.DatabaseName), -1)
 
 	// query = strings.Replace(query, "\t", "", -1)
 	// query = strings.Replace(query, "\n", "", -1)
 
-	logger.Debug(query)
+	res := db.sqlcmd(ctx, dbRequest.Username, dbRequest.Password, query)
+	if res.exitCode != 0 {
+		logFor(ctx).Error("Dump import seems to have failed:\n> stdout:\n'%s'\n> stderr:\n'%s'\n> exitCode: %d", res.stdout, res.stderr, res.exitCode)
+
+		return fmt.Errorf("import failed with exitcode '%d'", res.exitCode)
+	}
+
+	return nil
+}
+
+func (db *mssql) ExportDatabase(ctx context.Context, dbRequest model.DBRequest) (string, error) {
+	fullDumpFilename := fmt.Sprintf("%s_%s.bak", dbRequest.DatabaseName, time.Now().Format("20060102150405"))
 
-	args := append(connectArgs, "-Q", query)
+	query := mssqlExportQueryTmpl
 
-	res := RunCommand(conf.Exec, args...)
+	query = strings.Replace(query, "$(dumpPath)", quoteMSSQLLiteral(filepath.Join(workdir, "exports", fullDumpFilename)), -1)
+	query = strings.Replace(query, "$(databaseName)", quoteMSSQLIdentifier(dbRequest.DatabaseName), -1)
+
+	res := db.sqlcmd(ctx, dbRequest.Username, dbRequest.Password, query)
 	if res.exitCode != 0 {
-		logger.Error("Dump import seems to have failed:\n> stdout:\n'%s'\n> stderr:\n'%s'\n> exitCode: %d", res.stdout, res.stderr, res.exitCode)
+		logFor(ctx).Error("Database export seems to have failed:\n> stdout:\n'%s'\n> stderr:\n'%s'\n> exitCode: %d", res.stdout, res.stderr, res.exitCode)
 
-		return fmt.Errorf("import failed with exitcode '%q'", res.exitCode)
+		return "", fmt.Errorf("export failed with exitcode '%d'", res.exitCode)
 	}
 
-	return nil
+	return fullDumpFilename, nil
 }
 
-func (db *mssql) ExportDatabase(dbRequest model.DBRequest) (string, error) {
-	//fullDumpFilename := fmt.Sprintf("%s_%s.dmp", dbRequest.DatabaseName, time.Now().Format("20060102150405"))
+// CopyDatabase creates the database and the login of the request, then backs
+// up the source database and restores the backup over the new one, moving its
+// files. The backup is written to a temporary folder of the working directory
+// and is removed afterwards.
+func (db *mssql) CopyDatabase(ctx context.Context, source string, dbRequest model.DBRequest) error {
+	err := db.CreateDatabase(dbRequest)
+	if err != nil {
+		return err
+	}
+
+	databaseCreated(ctx)
+
+	// The backup is kept out of the exports folder, so that it's not listed or
+	// served as an export. SQL Server writes it as its own user, so others may
+	// create files in the folder, but not list them.
+	backupDir, err := ioutil.TempDir(workdir, "copy-")
+	if err != nil {
+		return fmt.Errorf("could not create folder for the backup: %s", err.Error())
+	}
+	defer os.RemoveAll(backupDir)
+
+	err = os.Chmod(backupDir, 0733)
+	if err != nil {
+		return fmt.Errorf("could not create folder for the backup: %s", err.Error())
+	}
+
+	backupPath := filepath.Join(backupDir, fmt.Sprintf("copy_%s_%s.bak", source, time.Now().Format("20060102150405")))
 
-	return "", fmt.Errorf("export not yet implemented for MSSQL")
+	query := mssqlExportQueryTmpl
+
+	query = strings.Replace(query, "$(dumpPath)", quoteMSSQLLiteral(backupPath), -1)
+	query = strings.Replace(query, "$(databaseName)", quoteMSSQLIdentifier(source), -1)
+
+	res := db.sqlcmd(ctx, conf.User, conf.Password, query)
+	if res.exitCode != 0 {
+		logFor(ctx).Error("Backing up the source database seems to have failed:\n> stdout:\n'%s'\n> stderr:\n'%s'\n> exitCode: %d", res.stdout, res.stderr, res.exitCode)
+
+		return fmt.Errorf("backing up %q failed with exitcode '%d'", source, res.exitCode)
+	}
+
+	dbRequest.DumpLocation = backupPath
+
+	return db.ImportDatabase(ctx, dbRequest)
 }
 
+// ListDatabase returns a list of the user databases on the server. The
+// system databases (master, model, msdb and tempdb) are omitted.
 func (db *mssql) ListDatabase() ([]string, error) {
-	return nil, fmt.Errorf("operation not supported: ListDatabase")
+	query := "SET NOCOUNT ON; SELECT name FROM sys.databases WHERE name NOT IN ('master', 'model', 'msdb', 'tempdb') ORDER BY name"
+
+	res := db.sqlcmd(context.Background(), conf.User, conf.Password, query, "-h", "-1", "-W")
+
+	if res.exitCode != 0 {
+		logger.Error("Unable to list databases:\n> stdout:\n%q\n> stderr:\n%q\n> exitCode: %d", res.stdout, res.stderr, res.exitCode)
+
+		return nil, fmt.Errorf("listing databases failed with exitcode '%d'", res.exitCode)
+	}
+
+	return parseList(res.stdout), nil
 }
 
 func (db *mssql) Version() (string, error) {
-	connectArgs := db.getConnectArg()
-
-	args := append(connectArgs, "-h", "-1", "-W", "-Q",
-		"SET NOCOUNT ON; SELECT (CAST(SERVERPROPERTY('productversion') AS nvarchar(128)) + SPACE(1) + CAST(SERVERPROPERTY('productlevel') AS nvarchar(128)) + SPACE(1) + CAST(SERVERPROPERTY('edition') AS nvarchar(128)))")
+	query := "SET NOCOUNT ON; SELECT (CAST(SERVERPROPERTY('productversion') AS nvarchar(128)) + SPACE(1) + CAST(SERVERPROPERTY('productlevel') AS nvarchar(128)) + SPACE(1) + CAST(SERVERPROPERTY('edition') AS nvarchar(128)))"
 
-	res := RunCommand(conf.Exec, args...)
+	res := db.sqlcmd(context.Background(), conf.User, conf.Password, query, "-h", "-1", "-W")
 
 	if res.exitCode != 0 {
 		logger.Error("Unable to get SQL Server version:\n> stdout:\n%q\n> stderr:\n%q\n> exitCode: %d", res.stdout, res.stderr, res.exitCode)
@@ -192,45 +256,32 @@ func (db *mssql) ValidateDump(path string) (string, error) {
 	return path, nil
 }
 
-func (db *mssql) getConnectArg() []string {
-	connect := db.getConnectSlice(conf.User, conf.Password)
-
-	logger.Debug("MSSQL connection argument: %s", connect)
-
-	return connect
-}
-
-func (db *mssql) getConnectString(user, password string) string {
+// sqlcmd runs the query with sqlcmd as the user, along with the additional
+// arguments. The password is passed in SQLCMDPASSWORD and the query in a
+// temporary file readable only by the agent, passed with -i, so that neither
+// of them is visible in the arguments of the process. The errors of the server
+// are written to stderr, where they're looked for, instead of stdout.
+func (db *mssql) sqlcmd(ctx context.Context, user, password, query string, args ...string) CommandResult {
 	hostAndPort := strings.Split(conf.LocalDBAddr, ":")
 
 	host := hostAndPort[0]
 	port := hostAndPort[1]
 
-	res := fmt.Sprintf("-b -S tcp:%s,%s -U %s -P %s",
-		host,
-		port,
-		user,
-		password,
-	)
-
-	return res
-}
-
-func (db *mssql) getConnectSlice(user, password string) []string {
-	hostAndPort := strings.Split(conf.LocalDBAddr, ":")
-
-	host := hostAndPort[0]
-	port := hostAndPort[1]
+	// The query is passed in a file that only the agent can read, as it may
+	// contain passwords, and sqlcmd can't read it from /dev/stdin everywhere.
+	script, err := writeSecretFile("ddn-sqlcmd", query)
+	if err != nil {
+		return CommandResult{stderr: err.Error(), exitCode: defaultFailedCode}
+	}
+	defer os.Remove(script)
 
-	res := []string{
-		"-b",
-		"-S",
-		fmt.Sprintf("tcp:%s,%s", host, port),
-		"-U",
-		user,
-		"-P",
-		password,
+	c := command{
+		name: conf.Exec,
+		args: []string{"-b", "-r1", "-S", fmt.Sprintf("tcp:%s,%s", host, port), "-U", user, "-i", script},
+		env:  []string{"SQLCMDPASSWORD=" + password},
 	}
 
-	return res
+	c.args = append(c.args, args...)
+
+	return runCommand(ctx, c)
 }
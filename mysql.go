@@ -2,8 +2,11 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -15,15 +18,38 @@ import (
 
 	"github.com/djavorszky/ddn-common/logger"
 	"github.com/djavorszky/ddn-common/model"
+	"github.com/djavorszky/ddn-common/status"
 	"github.com/djavorszky/sutils"
 
-	_ "github.com/go-sql-driver/mysql"
+	mysqldriver "github.com/go-sql-driver/mysql"
 )
 
+// mysqlErrDatabaseExists is the number of the error returned when creating a
+// database that already exists.
+const mysqlErrDatabaseExists = 1007
+
 type mysql struct {
 	conn *sql.DB
 }
 
+// mysqlFilteredPrefixes are the beginnings of the lines that are removed from
+// dumps before they are imported.
+var mysqlFilteredPrefixes = []string{
+	"CREATE DATABASE",
+	"DROP DATABASE",
+	"/*!50013 DEFINER",
+	"USE ",
+	"SET @@SESSION.SQL_LOG_BIN",
+	"SET @@GLOBAL.GTID",
+
+	"create database",
+	"drop database",
+	"/*!50013 definer",
+	"use ",
+	"set @@session.sql_log_bin",
+	"set @@global.gtid",
+}
+
 // Connect creates and initialises a Database struct and connects to the database
 func (db *mysql) Connect(c Config) error {
 	var err error
@@ -57,11 +83,13 @@ func (db *mysql) Alive() error {
 	defer func() {
 		if p := recover(); p != nil {
 			logger.Error("Panic Attack! Database seems to be down.")
+			aliveFailures.inc()
 		}
 	}()
 
 	_, err := db.conn.Exec("select * from mysql.user WHERE 1 = 0")
 	if err != nil {
+		aliveFailures.inc()
 		return fmt.Errorf("executing stayalive query failed: %s", strip(err.Error()))
 	}
 
@@ -112,6 +140,13 @@ func (db *mysql) ListDatabase() ([]string, error) {
 // CreateDatabase creates a Database along with a user, to which all privileges
 // are granted on the created database. Fails if database or user already exists.
 func (db *mysql) CreateDatabase(dbRequest model.DBRequest) error {
+	return db.CreateDatabaseWithOptions(dbRequest, DatabaseOptions{}.withDefaults())
+}
+
+// CreateDatabaseWithOptions works the same way as CreateDatabase, except that
+// the database is created with the charset and the collation of the options.
+// If neither is given, the database is created with utf8.
+func (db *mysql) CreateDatabaseWithOptions(dbRequest model.DBRequest, opts DatabaseOptions) error {
 	err := db.Alive()
 	if err != nil {
 		return fmt.Errorf("alive check failed: %s", err.Error())
@@ -132,7 +167,7 @@ func (db *mysql) CreateDatabase(dbRequest model.DBRequest) error {
 		return fmt.Errorf("checking if database exists failed: %s", err.Error())
 	}
 	if exists {
-		return fmt.Errorf("database '%s' already exists", dbRequest.DatabaseName)
+		return fmt.Errorf("database '%s' %w", dbRequest.DatabaseName, errTargetExists)
 	}
 
 	// Begin transaction so that we can roll it back at any point something goes wrong.
@@ -142,9 +177,29 @@ func (db *mysql) CreateDatabase(dbRequest model.DBRequest) error {
 		return fmt.Errorf("starting transaction failed: %s", strip(err.Error()))
 	}
 
-	_, err = db.conn.Exec(fmt.Sprintf("CREATE DATABASE %s CHARSET utf8;", dbRequest.DatabaseName))
+	charset := opts.Charset
+	if charset == "" && opts.Collation == "" {
+		charset = "utf8"
+	}
+
+	query := fmt.Sprintf("CREATE DATABASE %s", quoteMySQLIdentifier(dbRequest.DatabaseName))
+	if charset != "" {
+		query += fmt.Sprintf(" CHARACTER SET %s", quoteMySQLLiteral(charset))
+	}
+	if opts.Collation != "" {
+		query += fmt.Sprintf(" COLLATE %s", quoteMySQLLiteral(opts.Collation))
+	}
+
+	_, err = db.conn.Exec(query + ";")
 	if err != nil {
 		tx.Rollback()
+
+		// Someone else created the database since it was checked.
+		var mysqlErr *mysqldriver.MySQLError
+		if errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlErrDatabaseExists {
+			return fmt.Errorf("database '%s' %w", dbRequest.DatabaseName, errTargetExists)
+		}
+
 		return fmt.Errorf("executing create database query failed: %s", strip(err.Error()))
 	}
 
@@ -155,14 +210,14 @@ func (db *mysql) CreateDatabase(dbRequest model.DBRequest) error {
 	if !exists {
 		db.conn.Exec(fmt.Sprintf("FLUSH PRIVILEGES"))
 
-		_, err = db.conn.Exec(fmt.Sprintf("CREATE USER '%s' IDENTIFIED BY '%s';", dbRequest.Username, dbRequest.Password))
+		_, err = db.conn.Exec(fmt.Sprintf("CREATE USER %s@'%%' IDENTIFIED BY %s;", quoteMySQLLiteral(dbRequest.Username), quoteMySQLLiteral(dbRequest.Password)))
 		if err != nil {
 			tx.Rollback()
 			return fmt.Errorf("executing create user '%s' failed: %s", dbRequest.Username, strip(err.Error()))
 		}
 	}
 
-	_, err = db.conn.Exec(fmt.Sprintf("GRANT ALL PRIVILEGES ON %s.* TO '%s'@'%s';", dbRequest.DatabaseName, dbRequest.Username, "%"))
+	_, err = db.conn.Exec(fmt.Sprintf("GRANT ALL PRIVILEGES ON %s.* TO %s@'%%';", quoteMySQLIdentifier(dbRequest.DatabaseName), quoteMySQLLiteral(dbRequest.Username)))
 	if err != nil {
 		tx.Rollback()
 		return fmt.Errorf("executing grant privileges to user '%s' on database '%s' failed: %s", dbRequest.Username, dbRequest.DatabaseName, strip(err.Error()))
@@ -201,7 +256,7 @@ func (db *mysql) DropDatabase(dbRequest model.DBRequest) error {
 		return fmt.Errorf("starting transaction failed: %s", strip(err.Error()))
 	}
 
-	_, err = db.conn.Exec(fmt.Sprintf("DROP DATABASE IF EXISTS %s", dbRequest.DatabaseName))
+	_, err = db.conn.Exec(fmt.Sprintf("DROP DATABASE IF EXISTS %s", quoteMySQLIdentifier(dbRequest.DatabaseName)))
 	if err != nil {
 		tx.Rollback()
 		return fmt.Errorf("dropping database '%s' failed: %s", dbRequest.DatabaseName, strip(err.Error()))
@@ -216,7 +271,7 @@ func (db *mysql) DropDatabase(dbRequest model.DBRequest) error {
 	if exists {
 		// Silently try to revoke privileges. MySQL errors out if we're trying to revoke a privilege
 		// when there's no such privilege.
-		db.conn.Exec(fmt.Sprintf("REVOKE ALL PRIVILEGES ON %s.* FROM %q", dbRequest.DatabaseName, dbRequest.Username))
+		db.conn.Exec(fmt.Sprintf("REVOKE ALL PRIVILEGES ON %s.* FROM %s@'%%'", quoteMySQLIdentifier(dbRequest.DatabaseName), quoteMySQLLiteral(dbRequest.Username)))
 
 		var count int
 		err = db.conn.QueryRow("select count(*) from mysql.db where user = ?", dbRequest.Username).Scan(&count)
@@ -226,7 +281,7 @@ func (db *mysql) DropDatabase(dbRequest model.DBRequest) error {
 		}
 
 		if count == 0 {
-			_, err = db.conn.Exec(fmt.Sprintf("DROP USER %s", dbRequest.Username))
+			_, err = db.conn.Exec(fmt.Sprintf("DROP USER %s@'%%'", quoteMySQLLiteral(dbRequest.Username)))
 			if err != nil {
 				tx.Rollback()
 				return fmt.Errorf("dropping user '%s' failed: %s", dbRequest.Username, strip(err.Error()))
@@ -245,38 +300,44 @@ func (db *mysql) DropDatabase(dbRequest model.DBRequest) error {
 
 // ImportDatabase imports the dumpfile to the database or returns an error
 // if it failed for some reason.
-func (db *mysql) ImportDatabase(dbreq model.DBRequest) error {
-	var errBuf bytes.Buffer
-
+func (db *mysql) ImportDatabase(ctx context.Context, dbreq model.DBRequest) error {
 	file, err := os.Open(dbreq.DumpLocation)
 	if err != nil {
-		db.DropDatabase(dbreq)
 		return fmt.Errorf("could not open dumpfile '%s': %s", dbreq.DumpLocation, err.Error())
 	}
 	defer file.Close()
 
-	hostAndPort := strings.Split(conf.LocalDBAddr, ":")
+	var size int64 = -1
+	if info, err := file.Stat(); err == nil {
+		size = info.Size()
+	}
 
-	host := hostAndPort[0]
-	port := hostAndPort[1]
+	return db.ImportStream(ctx, dbreq, trackProgress(ctx, file, size, status.ImportInProgress, "Importing"))
+}
 
-	// Start the import
-	args := []string{
-		fmt.Sprintf("--host=%s", host),
-		fmt.Sprintf("--port=%s", port),
-		fmt.Sprintf("-u%s", dbreq.Username),
-		fmt.Sprintf("-p%s", dbreq.Password),
-		dbreq.DatabaseName,
+// ImportStream imports the dump read from r to the database or returns an error
+// if it failed for some reason.
+func (db *mysql) ImportStream(ctx context.Context, dbreq model.DBRequest, r io.Reader) error {
+	var errBuf bytes.Buffer
+
+	args, cleanup, err := db.clientArgs(dbreq)
+	if err != nil {
+		return err
 	}
+	defer cleanup()
 
-	cmd := exec.Command(conf.Exec, args...)
+	// Start the import
+	cmd := exec.CommandContext(ctx, conf.Exec, append(args, dbreq.DatabaseName)...)
 
-	cmd.Stdin = file
+	cmd.Stdin = r
 	cmd.Stderr = &errBuf
 
 	err = cmd.Run()
 	if err != nil {
-		db.DropDatabase(dbreq)
+		if errBuf.Len() == 0 {
+			return fmt.Errorf("could not execute import command: %v", err)
+		}
+
 		return fmt.Errorf("could not execute import command: %s", strip(errBuf.String()))
 	}
 
@@ -285,9 +346,7 @@ func (db *mysql) ImportDatabase(dbreq model.DBRequest) error {
 
 // ExportDatabase exports the database to dumpfile or returns an error
 // if it failed for some reason.
-func (db *mysql) ExportDatabase(dbreq model.DBRequest) (string, error) {
-	var errBuf bytes.Buffer
-
+func (db *mysql) ExportDatabase(ctx context.Context, dbreq model.DBRequest) (string, error) {
 	fullDumpFilename := fmt.Sprintf("%s_%s.sql", dbreq.DatabaseName, time.Now().Format("20060102150405"))
 
 	outputfile, err := os.Create(filepath.Join(workdir, "exports", fullDumpFilename))
@@ -296,31 +355,145 @@ func (db *mysql) ExportDatabase(dbreq model.DBRequest) (string, error) {
 	}
 	defer outputfile.Close()
 
-	hostAndPort := strings.Split(conf.LocalDBAddr, ":")
+	err = db.ExportStream(ctx, dbreq, outputfile)
+	if err != nil {
+		os.Remove(outputfile.Name())
+		return "", err
+	}
 
-	host := hostAndPort[0]
-	port := hostAndPort[1]
+	return fullDumpFilename, nil
+}
 
-	args := []string{
-		fmt.Sprintf("--host=%s", host),
-		fmt.Sprintf("--port=%s", port),
-		fmt.Sprintf("-u%s", dbreq.Username),
-		fmt.Sprintf("-p%s", dbreq.Password),
-		dbreq.DatabaseName,
+// ExportStream writes the dump of the database to w using mysqldump.
+func (db *mysql) ExportStream(ctx context.Context, dbreq model.DBRequest, w io.Writer) error {
+	var errBuf bytes.Buffer
+
+	args, cleanup, err := db.clientArgs(dbreq)
+	if err != nil {
+		return err
 	}
+	defer cleanup()
 
-	cmd := exec.Command("mysqldump", args...)
+	cmd := exec.CommandContext(ctx, "mysqldump", append(args, dbreq.DatabaseName)...)
 
-	cmd.Stdout = outputfile
+	cmd.Stdout = w
 	cmd.Stderr = &errBuf
 
 	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("could not execute mysqldump command: %s", strip(errBuf.String()))
+	}
+
+	return nil
+}
+
+// CopyDatabase creates the database of the request with the charset and the
+// collation of the source, then pipes the output of mysqldump into mysql. Both
+// run as the configured user, so that the definers of views, triggers and
+// routines can be kept.
+func (db *mysql) CopyDatabase(ctx context.Context, source string, dbRequest model.DBRequest) error {
+	var opts DatabaseOptions
 
+	err := db.conn.QueryRow("SELECT DEFAULT_CHARACTER_SET_NAME, DEFAULT_COLLATION_NAME FROM INFORMATION_SCHEMA.SCHEMATA WHERE SCHEMA_NAME = ?", source).Scan(&opts.Charset, &opts.Collation)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("source database %q does not exist", source)
+	}
 	if err != nil {
-		return "", fmt.Errorf("could not execute mysqldump command: %s", strip(errBuf.String()))
+		return fmt.Errorf("checking source database failed: %s", strip(err.Error()))
 	}
 
-	return fullDumpFilename, nil
+	err = db.CreateDatabaseWithOptions(dbRequest, opts)
+	if err != nil {
+		return fmt.Errorf("creating database failed: %w", err)
+	}
+
+	databaseCreated(ctx)
+
+	args, cleanup, err := db.clientArgs(model.DBRequest{Username: conf.User, Password: conf.Password})
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	var dumpErr, importErr bytes.Buffer
+
+	pr, pw := io.Pipe()
+
+	dump := exec.CommandContext(ctx, "mysqldump", append(args, "--single-transaction", "--routines", source)...)
+	dump.Stdout = pw
+	dump.Stderr = &dumpErr
+
+	imp := exec.CommandContext(ctx, conf.Exec, append(args, dbRequest.DatabaseName)...)
+	imp.Stdin = trackProgress(ctx, pr, -1, status.CopyInProgress, "Copying")
+	imp.Stderr = &importErr
+
+	err = dump.Start()
+	if err != nil {
+		return fmt.Errorf("could not execute mysqldump command: %s", err.Error())
+	}
+
+	dumped := make(chan error, 1)
+	go func() {
+		err := dump.Wait()
+		pw.CloseWithError(err)
+
+		dumped <- err
+	}()
+
+	err = imp.Run()
+
+	// Unblocks mysqldump if mysql has stopped reading.
+	pr.Close()
+
+	if derr := <-dumped; derr != nil {
+		if dumpErr.Len() == 0 {
+			return fmt.Errorf("could not execute mysqldump command: %v", derr)
+		}
+
+		return fmt.Errorf("could not execute mysqldump command: %s", strip(dumpErr.String()))
+	}
+
+	if err != nil {
+		if importErr.Len() == 0 {
+			return fmt.Errorf("could not execute import command: %v", err)
+		}
+
+		return fmt.Errorf("could not execute import command: %s", strip(importErr.String()))
+	}
+
+	return nil
+}
+
+// clientArgs returns the arguments that connect the mysql client tools to the
+// database as the user of the request. The password is written to an option
+// file instead of the arguments, which are visible to every user of the
+// machine. The returned function removes the option file.
+func (db *mysql) clientArgs(dbreq model.DBRequest) ([]string, func(), error) {
+	hostAndPort := strings.Split(conf.LocalDBAddr, ":")
+
+	host := hostAndPort[0]
+	port := hostAndPort[1]
+
+	optionFile, err := writeSecretFile("ddn-mysql-", mysqlOptionFile(dbreq.Password))
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not create option file: %s", err.Error())
+	}
+
+	// --defaults-extra-file has to be the first argument.
+	args := []string{
+		fmt.Sprintf("--defaults-extra-file=%s", optionFile),
+		fmt.Sprintf("--host=%s", host),
+		fmt.Sprintf("--port=%s", port),
+		fmt.Sprintf("-u%s", dbreq.Username),
+	}
+
+	return args, func() { os.Remove(optionFile) }, nil
+}
+
+// mysqlOptionFile returns the content of an option file with the password for
+// the client tools. The value is quoted, so only backslashes are escaped.
+func mysqlOptionFile(password string) string {
+	return fmt.Sprintf("[client]\npassword=\"%s\"\n", strings.Replace(password, `\`, `\\`, -1))
 }
 
 func (db *mysql) Version() (string, error) {
@@ -351,6 +524,44 @@ func (db *mysql) RequiredFields(dbreq model.DBRequest, reqType int) []string {
 	return req
 }
 
+// ValidateOptions returns an error if the server does not support the charset
+// or the collation, or if the collation does not belong to the charset.
+func (db *mysql) ValidateOptions(opts DatabaseOptions) error {
+	if opts.Locale != "" {
+		return fmt.Errorf("mysql does not support the locale of databases, set the collation instead")
+	}
+
+	if opts.Charset != "" {
+		var count int
+
+		err := db.conn.QueryRow("SELECT count(*) FROM INFORMATION_SCHEMA.CHARACTER_SETS WHERE CHARACTER_SET_NAME = ?", opts.Charset).Scan(&count)
+		if err != nil {
+			return fmt.Errorf("checking charset failed: %s", strip(err.Error()))
+		}
+		if count == 0 {
+			return fmt.Errorf("charset %q is not supported by the server", opts.Charset)
+		}
+	}
+
+	if opts.Collation != "" {
+		var charset string
+
+		err := db.conn.QueryRow("SELECT CHARACTER_SET_NAME FROM INFORMATION_SCHEMA.COLLATIONS WHERE COLLATION_NAME = ?", opts.Collation).Scan(&charset)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("collation %q is not supported by the server", opts.Collation)
+		}
+		if err != nil {
+			return fmt.Errorf("checking collation failed: %s", strip(err.Error()))
+		}
+
+		if opts.Charset != "" && !strings.EqualFold(charset, opts.Charset) {
+			return fmt.Errorf("collation %q belongs to charset %q, not %q", opts.Collation, charset, opts.Charset)
+		}
+	}
+
+	return nil
+}
+
 func (db *mysql) dbExists(databasename string) (bool, error) {
 	var count int
 
@@ -383,22 +594,14 @@ func strip(test string) string {
 	return strings.TrimSuffix(test, "\n")
 }
 
+// FilteredPrefixes returns the beginnings of the lines that ValidateDump
+// removes from the dumps.
+func (db *mysql) FilteredPrefixes() []string {
+	return mysqlFilteredPrefixes
+}
+
 func (db *mysql) ValidateDump(path string) (string, error) {
-	toRemove := []string{
-		"CREATE DATABASE",
-		"DROP DATABASE",
-		"/*!50013 DEFINER",
-		"USE ",
-		"SET @@SESSION.SQL_LOG_BIN",
-		"SET @@GLOBAL.GTID",
-
-		"create database",
-		"drop database",
-		"/*!50013 definer",
-		"use ",
-		"set @@session.sql_log_bin",
-		"set @@global.gtid",
-	}
+	toRemove := mysqlFilteredPrefixes
 
 	file, err := os.Open(path)
 	if err != nil {
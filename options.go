@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/djavorszky/ddn-common/model"
+)
+
+// optionPattern restricts the names of charsets, collations and locales to
+// the characters they consist of on any server, e.g. "en_US.UTF-8@euro".
+var optionPattern = regexp.MustCompile(`^[A-Za-z0-9_.@-]{1,64}$`)
+
+// isEmpty returns true if none of the options are set.
+func (o DatabaseOptions) isEmpty() bool {
+	return o == DatabaseOptions{}
+}
+
+// withDefaults returns the options with the empty fields set to the defaults
+// in the configuration of the agent. The charset and the collation are only
+// defaulted together, as the configured ones may not go with the given one.
+func (o DatabaseOptions) withDefaults() DatabaseOptions {
+	if o.Charset == "" && o.Collation == "" {
+		o.Charset = conf.Charset
+		o.Collation = conf.Collation
+	}
+
+	if o.Locale == "" {
+		o.Locale = conf.Locale
+	}
+
+	return o
+}
+
+// validateOptions returns an error if the options are malformed or if the
+// database server does not support them.
+func validateOptions(opts DatabaseOptions) error {
+	fields := []struct{ name, value string }{
+		{"charset", opts.Charset},
+		{"collation", opts.Collation},
+		{"locale", opts.Locale},
+	}
+
+	for _, f := range fields {
+		if f.value != "" && !optionPattern.MatchString(f.value) {
+			return fmt.Errorf("%s %q contains characters that are not allowed", f.name, f.value)
+		}
+	}
+
+	if opts.isEmpty() {
+		return nil
+	}
+
+	oc, ok := db.(OptionsCreator)
+	if !ok {
+		return fmt.Errorf("%s does not support setting the charset, the collation or the locale", conf.Vendor)
+	}
+
+	return oc.ValidateOptions(opts)
+}
+
+// createWithOptions creates the database of the request with the options, and
+// the defaults of the agent for the options that are not given.
+func createWithOptions(dbreq model.DBRequest, opts DatabaseOptions) error {
+	oc, ok := db.(OptionsCreator)
+	if !ok {
+		return db.CreateDatabase(dbreq)
+	}
+
+	return oc.CreateDatabaseWithOptions(dbreq, opts.withDefaults())
+}
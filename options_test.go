@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWithDefaults(t *testing.T) {
+	c := conf
+	defer func() { conf = c }()
+
+	conf.Charset, conf.Collation, conf.Locale = "utf8mb4", "utf8mb4_unicode_ci", "en_US.UTF-8"
+
+	tests := []struct {
+		opts, want DatabaseOptions
+	}{
+		{DatabaseOptions{}, DatabaseOptions{"utf8mb4", "utf8mb4_unicode_ci", "en_US.UTF-8"}},
+		{DatabaseOptions{Charset: "latin1"}, DatabaseOptions{"latin1", "", "en_US.UTF-8"}},
+		{DatabaseOptions{Collation: "utf8_bin"}, DatabaseOptions{"", "utf8_bin", "en_US.UTF-8"}},
+		{DatabaseOptions{"UTF8", "C", "de_DE.UTF-8"}, DatabaseOptions{"UTF8", "C", "de_DE.UTF-8"}},
+	}
+
+	for _, tt := range tests {
+		if got := tt.opts.withDefaults(); got != tt.want {
+			t.Errorf("%+v.withDefaults() = %+v, want %+v", tt.opts, got, tt.want)
+		}
+	}
+}
+
+func TestValidateOptions(t *testing.T) {
+	d, c := db, conf
+	defer func() { db, conf = d, c }()
+
+	db, conf.Vendor = new(mssql), "mssql"
+
+	tests := []struct {
+		opts DatabaseOptions
+		err  string
+	}{
+		{DatabaseOptions{}, ""},
+		{DatabaseOptions{Charset: "utf8'; DROP DATABASE x; --"}, "not allowed"},
+		{DatabaseOptions{Locale: "en US"}, "not allowed"},
+		{DatabaseOptions{Collation: "Latin1_General_CI_AS"}, "does not support"},
+	}
+
+	for _, tt := range tests {
+		err := validateOptions(tt.opts)
+
+		if tt.err == "" && err != nil {
+			t.Errorf("validateOptions(%+v) returned error: %v", tt.opts, err)
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("validateOptions(%+v) = %v, want error containing %q", tt.opts, err, tt.err)
+		}
+	}
+}
+
+func TestPostgresCreateDatabase(t *testing.T) {
+	tests := []struct {
+		opts DatabaseOptions
+		want string
+	}{
+		{DatabaseOptions{}, `CREATE DATABASE "db" ENCODING 'utf-8';`},
+		{DatabaseOptions{Charset: "LATIN1"}, `CREATE DATABASE "db" ENCODING 'LATIN1' TEMPLATE template0;`},
+		{DatabaseOptions{Locale: "en_US.UTF-8"}, `CREATE DATABASE "db" ENCODING 'utf-8' TEMPLATE template0 LC_COLLATE 'en_US.UTF-8' LC_CTYPE 'en_US.UTF-8';`},
+		{DatabaseOptions{"UTF8", "C", "en_US.UTF-8"}, `CREATE DATABASE "db" ENCODING 'UTF8' TEMPLATE template0 LC_COLLATE 'C' LC_CTYPE 'en_US.UTF-8';`},
+	}
+
+	for _, tt := range tests {
+		if got := postgresCreateDatabase("db", tt.opts); got != tt.want {
+			t.Errorf("postgresCreateDatabase(%+v) = %q, want %q", tt.opts, got, tt.want)
+		}
+	}
+}
+
+func TestNormaliseLocale(t *testing.T) {
+	tests := []struct {
+		locale, want string
+	}{
+		{"en_US.UTF-8", "en_US.utf8"},
+		{"en_US.utf8", "en_US.utf8"},
+		{"de_DE.ISO-8859-1@euro", "de_DE.iso88591@euro"},
+		{"en_US", "en_US"},
+		{"C", "C"},
+	}
+
+	for _, tt := range tests {
+		if got := normaliseLocale(tt.locale); got != tt.want {
+			t.Errorf("normaliseLocale(%q) = %q, want %q", tt.locale, got, tt.want)
+		}
+	}
+}
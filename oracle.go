@@ -1,20 +1,34 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"os"
 	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/djavorszky/ddn-common/logger"
 	"github.com/djavorszky/ddn-common/model"
 )
 
+// The alive check of Oracle needs to start sqlplus, so its result is cached for
+// a short while, and a hanging sqlplus is killed after a while.
+const (
+	oracleAliveTimeout  = 10 * time.Second
+	oracleAliveCacheTTL = 5 * time.Second
+)
+
 type oracle struct {
 	conn *sql.DB
+
+	aliveMu      sync.Mutex
+	aliveChecked time.Time
+	aliveErr     error
 }
 
 func (db *oracle) Connect(c Config) error {
@@ -26,14 +40,7 @@ func (db *oracle) Connect(c Config) error {
 		}
 	}
 
-	args := []string{
-		"-L",
-		"-S",
-		db.getConnectArg(),
-		"SELECT 1;",
-	}
-
-	res := RunCommand(c.Exec, args...)
+	res := db.sqlplus(context.Background(), conf.User, conf.Password, "./sql/oracle/alive.sql")
 
 	if res.exitCode != 0 {
 		return fmt.Errorf("failed to connect to database: %v", res)
@@ -43,13 +50,7 @@ func (db *oracle) Connect(c Config) error {
 }
 
 func (db *oracle) doGrants() error {
-	args := []string{
-		db.getConnectString("sys", conf.SysPassword),
-		"@./sql/oracle/grant_user.sql",
-		conf.User,
-	}
-
-	res := RunCommand(conf.Exec, args...)
+	res := db.sqlplus(context.Background(), "sys", conf.SysPassword, "./sql/oracle/grant_user.sql", conf.User)
 
 	if res.exitCode != 0 {
 		return fmt.Errorf("failed granting roles to %s: %v", conf.User, res)
@@ -62,8 +63,31 @@ func (db *oracle) Close() {
 	db.conn.Close()
 }
 
+// Alive checks whether the database is alive by running a trivial query through
+// sqlplus. Returns error if not. The result is reused for oracleAliveCacheTTL.
 func (db *oracle) Alive() error {
-	return nil
+	db.aliveMu.Lock()
+	defer db.aliveMu.Unlock()
+
+	// A cached failure was counted when the check was made.
+	if time.Since(db.aliveChecked) < oracleAliveCacheTTL {
+		return db.aliveErr
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), oracleAliveTimeout)
+	defer cancel()
+
+	res := db.sqlplus(ctx, conf.User, conf.Password, "./sql/oracle/alive.sql")
+
+	db.aliveErr = nil
+	if res.exitCode != 0 {
+		db.aliveErr = fmt.Errorf("executing stayalive query failed: %v", res)
+		aliveFailures.inc()
+	}
+
+	db.aliveChecked = time.Now()
+
+	return db.aliveErr
 }
 
 func (db *oracle) CreateDatabase(dbRequest model.DBRequest) error {
@@ -72,20 +96,25 @@ func (db *oracle) CreateDatabase(dbRequest model.DBRequest) error {
 		return fmt.Errorf("alive check failed: %s", err.Error())
 	}
 
-	args := []string{
-		"-L",
-		"-S",
-		db.getConnectArg(),
-		"@./sql/oracle/create_schema.sql",
+	exists, err := db.schemaExists(dbRequest.Username)
+	if err != nil {
+		return fmt.Errorf("checking if user/schema exists failed: %s", err.Error())
+	}
+	if exists {
+		return fmt.Errorf("user/schema %s %w", dbRequest.Username, errTargetExists)
+	}
+
+	res := db.sqlplus(context.Background(), conf.User, conf.Password, "./sql/oracle/create_schema.sql",
 		dbRequest.Username,
 		dbRequest.Password,
 		conf.DatafileDir,
-	}
-
-	res := RunCommand(conf.Exec, args...)
+	)
 
-	if res.exitCode == 1920 {
-		return fmt.Errorf("user/schema %s already exists", dbRequest.Username)
+	// The exit code of sqlplus is truncated to 8 bits, so the error is looked
+	// up in the output. Another job may have created the tablespace (ORA-01543)
+	// or the user (ORA-01920) since the check.
+	if res.exitCode != 0 && oracleTargetExists(res) {
+		return fmt.Errorf("user/schema %s %w", dbRequest.Username, errTargetExists)
 	}
 
 	if res.exitCode != 0 {
@@ -95,16 +124,33 @@ func (db *oracle) CreateDatabase(dbRequest model.DBRequest) error {
 	return nil
 }
 
-func (db *oracle) DropDatabase(dbRequest model.DBRequest) error {
-	args := []string{
-		"-L",
-		"-S",
-		db.getConnectArg(),
-		"@./sql/oracle/drop_schema.sql",
-		dbRequest.Username,
+// schemaExists returns whether there is a user or a tablespace of the name,
+// even if it was not created by the agent and so is not listed by ListDatabase.
+func (db *oracle) schemaExists(name string) (bool, error) {
+	res := db.sqlplus(context.Background(), conf.User, conf.Password, "./sql/oracle/schema_exists.sql", name)
+
+	if res.exitCode != 0 {
+		return true, fmt.Errorf("executing query failed: %v", res)
 	}
 
-	res := RunCommand(conf.Exec, args...)
+	count, err := strconv.Atoi(strings.TrimSpace(res.stdout))
+	if err != nil {
+		return true, fmt.Errorf("unexpected output %q: %s", res.stdout, err.Error())
+	}
+
+	return count != 0, nil
+}
+
+// oracleTargetExists returns whether the schema could not be created because
+// its tablespace or its user already exists.
+func oracleTargetExists(res CommandResult) bool {
+	output := res.stdout + res.stderr
+
+	return strings.Contains(output, "ORA-01543") || strings.Contains(output, "ORA-01920")
+}
+
+func (db *oracle) DropDatabase(dbRequest model.DBRequest) error {
+	res := db.sqlplus(context.Background(), conf.User, conf.Password, "./sql/oracle/drop_schema.sql", dbRequest.Username)
 
 	if res.exitCode == 1918 { // ORA-01918: user xxx does not exist ---> return with success
 		return nil
@@ -117,26 +163,20 @@ func (db *oracle) DropDatabase(dbRequest model.DBRequest) error {
 	return nil
 }
 
-func (db *oracle) ImportDatabase(dbRequest model.DBRequest) error {
+func (db *oracle) ImportDatabase(ctx context.Context, dbRequest model.DBRequest) error {
 	dumpDir, fileName := filepath.Split(dbRequest.DumpLocation)
 
 	if conf.RemoteDumpsDir != "" {
 		dumpDir = conf.RemoteDumpsDir
 	}
 
-	args := []string{
-		"-L",
-		"-S",
-		db.getConnectArg(),
-		"@./sql/oracle/import_dump.sql",
+	res := db.sqlplus(ctx, conf.User, conf.Password, "./sql/oracle/import_dump.sql",
 		dumpDir,
 		fileName,
 		dbRequest.Username,
 		dbRequest.Password,
 		conf.DatafileDir,
-	}
-
-	res := RunCommand(conf.Exec, args...)
+	)
 
 	if res.exitCode != 0 {
 		return fmt.Errorf("dump import seems to have failed: %v", res)
@@ -145,18 +185,27 @@ func (db *oracle) ImportDatabase(dbRequest model.DBRequest) error {
 	return nil
 }
 
-func (db *oracle) ExportDatabase(dbRequest model.DBRequest) (string, error) {
+func (db *oracle) ExportDatabase(ctx context.Context, dbRequest model.DBRequest) (string, error) {
 	fullDumpFilename := fmt.Sprintf("%s_%s.dmp", dbRequest.DatabaseName, time.Now().Format("20060102150405"))
+
+	// The credentials are passed in a parameter file, so that they are not
+	// visible in the arguments of the process.
+	parfile, err := writeSecretFile("ddn-expdp-", fmt.Sprintf("userid=%s\n", db.getConnectString(conf.User, conf.Password)))
+	if err != nil {
+		return "", fmt.Errorf("could not create parameter file: %s", err.Error())
+	}
+	defer os.Remove(parfile)
+
 	// Start the export
 	args := []string{
-		db.getConnectArg(),
+		fmt.Sprintf("parfile=%s", parfile),
 		fmt.Sprintf("schemas=%s", dbRequest.DatabaseName),
 		"directory=EXP_DIR",
 		fmt.Sprintf("dumpfile=%s", fullDumpFilename),
 		fmt.Sprintf("logfile=%s.log", strings.TrimSuffix(fullDumpFilename, path.Ext(fullDumpFilename))),
 	}
 
-	res := RunCommand("expdp", args...)
+	res := RunCommandContext(ctx, "expdp", args...)
 
 	if res.exitCode != 0 {
 		return "", fmt.Errorf("schema export seems to have failed: %v", res)
@@ -165,19 +214,56 @@ func (db *oracle) ExportDatabase(dbRequest model.DBRequest) (string, error) {
 	return fullDumpFilename, nil
 }
 
-func (db *oracle) ListDatabase() ([]string, error) {
-	return nil, nil
+// CopyDatabase creates the schema of the request, then copies the source schema
+// into it with a Data Pump network import over a database link that points
+// back to the same database. The link is created for the copy and dropped
+// afterwards.
+func (db *oracle) CopyDatabase(ctx context.Context, source string, dbRequest model.DBRequest) error {
+	err := db.CreateDatabase(dbRequest)
+	if err != nil {
+		return fmt.Errorf("creating schema failed: %w", err)
+	}
+
+	databaseCreated(ctx)
+
+	// The link contains the password of the agent, so it's dropped even if the
+	// copy was cancelled.
+	defer func() {
+		res := db.sqlplus(context.Background(), conf.User, conf.Password, "./sql/oracle/drop_copy_link.sql", dbRequest.Username)
+		if res.exitCode != 0 {
+			logFor(ctx).Error("could not drop database link of the copy to %s: %v", dbRequest.Username, res)
+		}
+	}()
+
+	res := db.sqlplus(ctx, conf.User, conf.Password, "./sql/oracle/copy_schema.sql",
+		source,
+		dbRequest.Username,
+		db.descriptor(),
+		conf.User,
+		conf.Password,
+	)
+
+	if res.exitCode != 0 {
+		return fmt.Errorf("schema copy seems to have failed: %v", res)
+	}
+
+	return nil
 }
 
-func (db *oracle) Version() (string, error) {
-	args := []string{
-		"-L",
-		"-S",
-		db.getConnectArg(),
-		"@./sql/oracle/get_db_version.sql",
+// ListDatabase returns the schemas that were created by the agent. These are
+// recognised by having a default tablespace of the same name as the user.
+func (db *oracle) ListDatabase() ([]string, error) {
+	res := db.sqlplus(context.Background(), conf.User, conf.Password, "./sql/oracle/list_schemas.sql")
+
+	if res.exitCode != 0 {
+		return nil, fmt.Errorf("listing schemas failed: %v", res)
 	}
 
-	res := RunCommand(conf.Exec, args...)
+	return parseList(res.stdout), nil
+}
+
+func (db *oracle) Version() (string, error) {
+	res := db.sqlplus(context.Background(), conf.User, conf.Password, "./sql/oracle/get_db_version.sql")
 
 	if res.exitCode != 0 {
 		return "", fmt.Errorf("unable to get Oracle version: %v", res)
@@ -204,14 +290,7 @@ func (db *oracle) ValidateDump(path string) (string, error) {
 }
 
 func (db *oracle) RefreshImportStoredProcedure() error {
-	args := []string{
-		"-L",
-		"-S",
-		db.getConnectArg(),
-		"@./sql/oracle/import_procedure.sql",
-	}
-
-	res := RunCommand(conf.Exec, args...)
+	res := db.sqlplus(context.Background(), conf.User, conf.Password, "./sql/oracle/import_procedure.sql")
 
 	if res.exitCode != 0 {
 		logger.Error("Missing grants from SYS perhaps?")
@@ -226,14 +305,7 @@ func (db *oracle) RefreshImportStoredProcedure() error {
 }
 
 func (db *oracle) CreateExpDir(expDirPath string) error {
-	args := []string{
-		"-L",
-		"-S",
-		db.getConnectArg(),
-		"@./sql/oracle/create_exp_dir.sql",
-		expDirPath}
-
-	res := RunCommand(conf.Exec, args...)
+	res := db.sqlplus(context.Background(), conf.User, conf.Password, "./sql/oracle/create_exp_dir.sql", expDirPath)
 
 	if res.exitCode != 0 {
 		return fmt.Errorf("creating EXP_DIR directory failed: %v", res)
@@ -242,31 +314,50 @@ func (db *oracle) CreateExpDir(expDirPath string) error {
 	return nil
 }
 
-func (db *oracle) getConnectArg() string {
-	connect := db.getConnectString(conf.User, conf.Password)
+// sqlplus runs the script with sqlplus as the user, passing the arguments to
+// the script. sqlplus is started with /nolog, and the connect string and the
+// script are written to its stdin, so that neither the password nor the
+// arguments, which may contain passwords too, are visible in the arguments of
+// the process.
+func (db *oracle) sqlplus(ctx context.Context, user, password, script string, args ...string) CommandResult {
+	var in strings.Builder
+
+	// A failed connection ends sqlplus like it did with the connect string
+	// on the command line. The scripts handle their own errors afterwards.
+	in.WriteString("WHENEVER SQLERROR EXIT FAILURE\n")
+	fmt.Fprintf(&in, "CONNECT %s\n", db.getConnectString(user, password))
+	in.WriteString("WHENEVER SQLERROR CONTINUE\n")
+
+	fmt.Fprintf(&in, "@%s", script)
+	for _, arg := range args {
+		fmt.Fprintf(&in, " \"%s\"", arg)
+	}
 
-	logger.Debug("Oracle connection argument: %s", connect)
+	in.WriteString("\nEXIT\n")
 
-	return connect
+	return runCommand(ctx, command{name: conf.Exec, args: []string{"-L", "-S", "/nolog"}, stdin: in.String()})
 }
 
 func (db *oracle) getConnectString(user, password string) string {
+	res := fmt.Sprintf("%s/%s@'%s'", user, password, db.descriptor())
+
+	if user == "sys" {
+		res += " as sysdba"
+	}
+
+	return res
+}
+
+// descriptor returns the connect descriptor of the database.
+func (db *oracle) descriptor() string {
 	hostAndPort := strings.Split(conf.LocalDBAddr, ":")
 
 	host := hostAndPort[0]
 	port := hostAndPort[1]
 
-	res := fmt.Sprintf("%s/%s@'(DESCRIPTION=(ADDRESS=(PROTOCOL=tcp)(HOST=%s)(PORT=%s))(CONNECT_DATA=(SERVICE_NAME=%s)))'",
-		user,
-		password,
+	return fmt.Sprintf("(DESCRIPTION=(ADDRESS=(PROTOCOL=tcp)(HOST=%s)(PORT=%s))(CONNECT_DATA=(SERVICE_NAME=%s)))",
 		host,
 		port,
 		conf.SID,
 	)
-
-	if user == "sys" {
-		res += " as sysdba"
-	}
-
-	return res
 }
@@ -2,26 +2,36 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
 	"github.com/djavorszky/ddn-common/logger"
 	"github.com/djavorszky/ddn-common/model"
+	"github.com/djavorszky/ddn-common/status"
 	"github.com/djavorszky/sutils"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 type postgres struct {
 	conn *sql.DB
 }
 
+// postgresFilteredPrefixes are the beginnings of the lines that are removed
+// from dumps before they are imported.
+var postgresFilteredPrefixes = []string{"ALTER TABLE", "alter table"}
+
 func (db *postgres) Connect(c Config) error {
 	var err error
 
@@ -52,11 +62,13 @@ func (db *postgres) Alive() error {
 	defer func() {
 		if p := recover(); p != nil {
 			logger.Error("Panic Attack! Database seems to be down.")
+			aliveFailures.inc()
 		}
 	}()
 
 	_, err := db.conn.Exec("select 1 from pg_roles WHERE 1 = 0")
 	if err != nil {
+		aliveFailures.inc()
 		return fmt.Errorf("executing stayalive query failed: %s", err.Error())
 	}
 
@@ -107,6 +119,13 @@ func (db *postgres) ListDatabase() ([]string, error) {
 // CreateDatabase creates a Database along with a user, to which all privileges
 // are granted on the created database. Fails if database or user already exists.
 func (db *postgres) CreateDatabase(dbRequest model.DBRequest) error {
+	return db.CreateDatabaseWithOptions(dbRequest, DatabaseOptions{}.withDefaults())
+}
+
+// CreateDatabaseWithOptions works the same way as CreateDatabase, except that
+// the database is created with the encoding, the LC_COLLATE and the LC_CTYPE of
+// the options.
+func (db *postgres) CreateDatabaseWithOptions(dbRequest model.DBRequest, opts DatabaseOptions) error {
 	err := db.Alive()
 	if err != nil {
 		return fmt.Errorf("alive check failed: %s", err.Error())
@@ -117,7 +136,7 @@ func (db *postgres) CreateDatabase(dbRequest model.DBRequest) error {
 		return fmt.Errorf("checking if database exists failed: %s", err.Error())
 	}
 	if exists {
-		return fmt.Errorf("database '%s' already exists", dbRequest.DatabaseName)
+		return fmt.Errorf("database '%s' %w", dbRequest.DatabaseName, errTargetExists)
 	}
 
 	exists, err = db.userExists(dbRequest.Username)
@@ -125,7 +144,7 @@ func (db *postgres) CreateDatabase(dbRequest model.DBRequest) error {
 		return fmt.Errorf("checking if user exists failed: %s", err.Error())
 	}
 	if exists {
-		return fmt.Errorf("user '%s' already exists", dbRequest.Username)
+		return fmt.Errorf("user '%s' %w", dbRequest.Username, errTargetExists)
 	}
 
 	// Begin transaction so that we can roll it back at any point something goes wrong.
@@ -135,19 +154,19 @@ func (db *postgres) CreateDatabase(dbRequest model.DBRequest) error {
 		return fmt.Errorf("starting transaction failed: %s", err.Error())
 	}
 
-	_, err = db.conn.Exec(fmt.Sprintf("CREATE DATABASE %q ENCODING 'utf-8';", dbRequest.DatabaseName))
+	_, err = db.conn.Exec(postgresCreateDatabase(dbRequest.DatabaseName, opts))
 	if err != nil {
 		tx.Rollback()
 		return fmt.Errorf("executing create database query failed: %s", err.Error())
 	}
 
-	_, err = db.conn.Exec(fmt.Sprintf("CREATE USER %s WITH PASSWORD '%s';", dbRequest.Username, dbRequest.Password))
+	_, err = db.conn.Exec(fmt.Sprintf("CREATE USER %s WITH PASSWORD %s;", postgresUser(dbRequest.Username), quotePostgresLiteral(dbRequest.Password)))
 	if err != nil {
 		tx.Rollback()
 		return fmt.Errorf("executing create user '%s' failed: %s", dbRequest.Username, err.Error())
 	}
 
-	_, err = db.conn.Exec(fmt.Sprintf("GRANT ALL PRIVILEGES ON DATABASE %q TO %s;", dbRequest.DatabaseName, dbRequest.Username))
+	_, err = db.conn.Exec(fmt.Sprintf("GRANT ALL PRIVILEGES ON DATABASE %s TO %s;", pq.QuoteIdentifier(dbRequest.DatabaseName), postgresUser(dbRequest.Username)))
 	if err != nil {
 		tx.Rollback()
 		return fmt.Errorf("executing grant privileges to user '%s' on database '%s' failed: %s", dbRequest.Username, dbRequest.DatabaseName, err.Error())
@@ -178,13 +197,13 @@ func (db *postgres) DropDatabase(dbRequest model.DBRequest) error {
 		return fmt.Errorf("starting transaction failed: %s", err.Error())
 	}
 
-	_, err = db.conn.Exec(fmt.Sprintf("DROP DATABASE IF EXISTS %q", dbRequest.DatabaseName))
+	_, err = db.conn.Exec(fmt.Sprintf("DROP DATABASE IF EXISTS %s", pq.QuoteIdentifier(dbRequest.DatabaseName)))
 	if err != nil {
 		tx.Rollback()
 		return fmt.Errorf("dropping database '%s' failed: %s", dbRequest.DatabaseName, err.Error())
 	}
 
-	_, err = db.conn.Exec(fmt.Sprintf("DROP USER IF EXISTS %s", dbRequest.Username))
+	_, err = db.conn.Exec(fmt.Sprintf("DROP USER IF EXISTS %s", postgresUser(dbRequest.Username)))
 	if err != nil {
 		tx.Rollback()
 		return fmt.Errorf("dropping user '%s' failed: %s", dbRequest.Username, err.Error())
@@ -201,41 +220,103 @@ func (db *postgres) DropDatabase(dbRequest model.DBRequest) error {
 
 // ImportDatabase imports the dumpfile to the database or returns an error
 // if it failed for some reason.
-func (db *postgres) ImportDatabase(dbreq model.DBRequest) error {
-	addr := strings.Split(conf.LocalDBAddr, ":")
-	host, port := addr[0], addr[1]
-
-	cmd := exec.Command(conf.Exec, "-h", host, "-p", port, "-U", dbreq.Username, "-d", dbreq.DatabaseName)
-
-	logger.Debug("Executing command: %v", cmd)
-
+func (db *postgres) ImportDatabase(ctx context.Context, dbreq model.DBRequest) error {
 	file, err := os.Open(dbreq.DumpLocation)
 	if err != nil {
-		db.DropDatabase(dbreq)
 		return fmt.Errorf("could not open dumpfile '%s': %v", dbreq.DumpLocation, err)
 	}
 	defer file.Close()
 
-	cmd.Stdin = file
+	var size int64 = -1
+	if info, err := file.Stat(); err == nil {
+		size = info.Size()
+	}
+
+	return db.ImportStream(ctx, dbreq, trackProgress(ctx, file, size, status.ImportInProgress, "Importing"))
+}
+
+// ImportStream imports the dump read from r to the database or returns an error
+// if it failed for some reason.
+func (db *postgres) ImportStream(ctx context.Context, dbreq model.DBRequest, r io.Reader) error {
+	addr := strings.Split(conf.LocalDBAddr, ":")
+	host, port := addr[0], addr[1]
+
+	cmd := exec.CommandContext(ctx, conf.Exec, "-h", host, "-p", port, "-U", postgresUserName(dbreq.Username), "-d", dbreq.DatabaseName)
+
+	logFor(ctx).Debug("Executing command: %v", cmd)
+
+	cmd.Stdin = r
 
 	var errBuf bytes.Buffer
 	cmd.Stderr = &errBuf
 
-	os.Setenv("PGPASSWORD", dbreq.Password)
-	defer os.Setenv("PGPASSWORD", "")
-	err = cmd.Run()
+	// The password is set for the command only, as the environment of the
+	// agent is shared by the jobs running in parallel.
+	cmd.Env = append(os.Environ(), "PGPASSWORD="+dbreq.Password)
+
+	err := cmd.Run()
 	if err != nil {
-		db.DropDatabase(dbreq)
+		if errBuf.Len() == 0 {
+			return fmt.Errorf("could not execute import command: %v", err)
+		}
+
 		return fmt.Errorf("could not execute import command: %s", errBuf.String())
 	}
 
 	return nil
 }
 
-func (db *postgres) ExportDatabase(dbRequest model.DBRequest) (string, error) {
-	//fullDumpFilename := fmt.Sprintf("%s_%s.dmp", dbRequest.DatabaseName, time.Now().Format("20060102150405"))
+// ExportDatabase exports the database to dumpfile or returns an error
+// if it failed for some reason.
+func (db *postgres) ExportDatabase(ctx context.Context, dbreq model.DBRequest) (string, error) {
+	fullDumpFilename := fmt.Sprintf("%s_%s.sql", dbreq.DatabaseName, time.Now().Format("20060102150405"))
+
+	outputfile, err := os.Create(filepath.Join(workdir, "exports", fullDumpFilename))
+	if err != nil {
+		return "", fmt.Errorf("could not create dumpfile '%s': %s", fullDumpFilename, err.Error())
+	}
+	defer outputfile.Close()
+
+	err = db.ExportStream(ctx, dbreq, outputfile)
+	if err != nil {
+		os.Remove(outputfile.Name())
+		return "", err
+	}
+
+	return fullDumpFilename, nil
+}
+
+// ExportStream writes the dump of the database to w using pg_dump.
+func (db *postgres) ExportStream(ctx context.Context, dbreq model.DBRequest, w io.Writer) error {
+	var errBuf bytes.Buffer
+
+	addr := strings.Split(conf.LocalDBAddr, ":")
+	host, port := addr[0], addr[1]
+
+	args := []string{
+		"-h", host,
+		"-p", port,
+		"-U", postgresUserName(dbreq.Username),
+		"--no-owner",
+		"--no-privileges",
+		dbreq.DatabaseName,
+	}
+
+	cmd := exec.CommandContext(ctx, "pg_dump", args...)
+
+	cmd.Stdout = w
+	cmd.Stderr = &errBuf
+
+	// The password is set for the command only, as the environment of the
+	// agent is shared by the jobs running in parallel.
+	cmd.Env = append(os.Environ(), "PGPASSWORD="+dbreq.Password)
+
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("could not execute pg_dump command: %s", strip(errBuf.String()))
+	}
 
-	return "", fmt.Errorf("export not yet implemented for PostgreSQL")
+	return nil
 }
 
 func (db *postgres) Version() (string, error) {
@@ -267,8 +348,14 @@ func (db *postgres) RequiredFields(dbreq model.DBRequest, reqType int) []string
 	return req
 }
 
+// FilteredPrefixes returns the beginnings of the lines that ValidateDump
+// removes from the dumps.
+func (db *postgres) FilteredPrefixes() []string {
+	return postgresFilteredPrefixes
+}
+
 func (db *postgres) ValidateDump(path string) (string, error) {
-	toRemove := []string{"ALTER TABLE", "alter table"}
+	toRemove := postgresFilteredPrefixes
 
 	file, err := os.Open(path)
 	if err != nil {
@@ -306,12 +393,267 @@ func (db *postgres) ValidateDump(path string) (string, error) {
 	return path, nil
 }
 
+// CopyDatabase creates the database with the source as its template, then the
+// user of the request, and hands the objects of the copy over to the user.
+// Postgres can only copy a database that has no other connections, errSourceBusy
+// is returned otherwise.
+func (db *postgres) CopyDatabase(ctx context.Context, source string, dbRequest model.DBRequest) error {
+	exists, err := db.dbExists(source)
+	if err != nil {
+		return fmt.Errorf("checking if source database exists failed: %s", err.Error())
+	}
+	if !exists {
+		return fmt.Errorf("source database %q does not exist", source)
+	}
+
+	exists, err = db.dbExists(dbRequest.DatabaseName)
+	if err != nil {
+		return fmt.Errorf("checking if database exists failed: %s", err.Error())
+	}
+	if exists {
+		return fmt.Errorf("database '%s' %w", dbRequest.DatabaseName, errTargetExists)
+	}
+
+	exists, err = db.userExists(dbRequest.Username)
+	if err != nil {
+		return fmt.Errorf("checking if user exists failed: %s", err.Error())
+	}
+	if exists {
+		return fmt.Errorf("user '%s' %w", dbRequest.Username, errTargetExists)
+	}
+
+	// The database is created first, so that nothing is left behind if the
+	// source can't be copied.
+	_, err = db.conn.ExecContext(ctx, fmt.Sprintf("CREATE DATABASE %s TEMPLATE %s;", pq.QuoteIdentifier(dbRequest.DatabaseName), pq.QuoteIdentifier(source)))
+	if err != nil {
+		if strings.Contains(err.Error(), "is being accessed by other users") {
+			return fmt.Errorf("source database %q %w", source, errSourceBusy)
+		}
+
+		return fmt.Errorf("executing create database query failed: %s", err.Error())
+	}
+
+	databaseCreated(ctx)
+
+	_, err = db.conn.ExecContext(ctx, fmt.Sprintf("CREATE USER %s WITH PASSWORD %s;", postgresUser(dbRequest.Username), quotePostgresLiteral(dbRequest.Password)))
+	if err != nil {
+		return fmt.Errorf("executing create user '%s' failed: %s", dbRequest.Username, err.Error())
+	}
+
+	_, err = db.conn.ExecContext(ctx, fmt.Sprintf("GRANT ALL PRIVILEGES ON DATABASE %s TO %s;", pq.QuoteIdentifier(dbRequest.DatabaseName), postgresUser(dbRequest.Username)))
+	if err != nil {
+		return fmt.Errorf("executing grant privileges to user '%s' on database '%s' failed: %s", dbRequest.Username, dbRequest.DatabaseName, err.Error())
+	}
+
+	return db.handOver(ctx, dbRequest)
+}
+
+// handOver gives the objects of the copied database to the user of the request.
+// The tables, views, sequences and functions owned by the users of the source
+// are altered one by one, the rest are granted to the user in every schema.
+func (db *postgres) handOver(ctx context.Context, dbRequest model.DBRequest) error {
+	datasource := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(conf.User, conf.Password),
+		Host:     conf.LocalDBAddr,
+		Path:     "/" + dbRequest.DatabaseName,
+		RawQuery: "sslmode=disable",
+	}
+
+	conn, err := sql.Open("postgres", datasource.String())
+	if err != nil {
+		return fmt.Errorf("connecting to the copy failed: %s", err.Error())
+	}
+	defer conn.Close()
+
+	// REASSIGN OWNED can't be used, as it moves the databases and tablespaces
+	// of the owners on the whole server too. Sequences of columns follow their
+	// tables, and objects of extensions stay with the extensions.
+	query := `SELECT CASE c.relkind WHEN 'v' THEN 'VIEW' WHEN 'm' THEN 'MATERIALIZED VIEW' WHEN 'f' THEN 'FOREIGN TABLE'
+			WHEN 'S' THEN 'SEQUENCE' ELSE 'TABLE' END, quote_ident(n.nspname) || '.' || quote_ident(c.relname)
+		FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('r', 'p', 'v', 'm', 'f', 'S')
+		AND n.nspname NOT IN ('pg_catalog', 'information_schema') AND n.nspname NOT LIKE 'pg_toast%'
+		AND pg_get_userbyid(c.relowner) NOT IN ($1, $2)
+		AND NOT EXISTS (SELECT 1 FROM pg_depend d WHERE d.classid = 'pg_class'::regclass AND d.objid = c.oid AND d.deptype IN ('a', 'i', 'e'))
+		UNION ALL
+		SELECT 'FUNCTION', p.oid::regprocedure::text
+		FROM pg_proc p JOIN pg_namespace n ON n.oid = p.pronamespace
+		WHERE n.nspname NOT IN ('pg_catalog', 'information_schema')
+		AND pg_get_userbyid(p.proowner) NOT IN ($1, $2)
+		AND NOT EXISTS (SELECT 1 FROM pg_aggregate a WHERE a.aggfnoid = p.oid)
+		AND NOT EXISTS (SELECT 1 FROM pg_depend d WHERE d.classid = 'pg_proc'::regclass AND d.objid = p.oid AND d.deptype = 'e')`
+
+	rows, err := conn.QueryContext(ctx, query, conf.User, postgresUserName(dbRequest.Username))
+	if err != nil {
+		return fmt.Errorf("listing objects of the copy failed: %s", err.Error())
+	}
+
+	var alters []string
+	for rows.Next() {
+		var kind, name string
+		if err = rows.Scan(&kind, &name); err != nil {
+			rows.Close()
+			return fmt.Errorf("listing objects of the copy failed: %s", err.Error())
+		}
+
+		alters = append(alters, fmt.Sprintf("ALTER %s %s", kind, name))
+	}
+	rows.Close()
+
+	user := postgresUser(dbRequest.Username)
+
+	for _, alter := range alters {
+		_, err = conn.ExecContext(ctx, fmt.Sprintf("%s OWNER TO %s;", alter, user))
+		if err != nil {
+			return fmt.Errorf("changing owner with %q failed: %s", alter, err.Error())
+		}
+	}
+
+	rows, err = conn.QueryContext(ctx, `SELECT quote_ident(nspname) FROM pg_namespace
+		WHERE nspname NOT IN ('pg_catalog', 'information_schema') AND nspname NOT LIKE 'pg_toast%' AND nspname NOT LIKE 'pg_temp%'`)
+	if err != nil {
+		return fmt.Errorf("listing schemas of the copy failed: %s", err.Error())
+	}
+
+	var schemas []string
+	for rows.Next() {
+		var schema string
+		if err = rows.Scan(&schema); err != nil {
+			rows.Close()
+			return fmt.Errorf("listing schemas of the copy failed: %s", err.Error())
+		}
+
+		schemas = append(schemas, schema)
+	}
+	rows.Close()
+
+	// The objects that were not handed over, e.g. the ones of the configured
+	// user, are granted in every schema, not just public.
+	for _, schema := range schemas {
+		_, err = conn.ExecContext(ctx, fmt.Sprintf("GRANT ALL PRIVILEGES ON SCHEMA %s TO %s;", schema, user))
+		if err != nil {
+			return fmt.Errorf("granting schema %s to user '%s' failed: %s", schema, dbRequest.Username, err.Error())
+		}
+
+		for _, objects := range []string{"TABLES", "SEQUENCES", "FUNCTIONS"} {
+			_, err = conn.ExecContext(ctx, fmt.Sprintf("GRANT ALL PRIVILEGES ON ALL %s IN SCHEMA %s TO %s;", objects, schema, user))
+			if err != nil {
+				return fmt.Errorf("granting %s in schema %s to user '%s' failed: %s", strings.ToLower(objects), schema, dbRequest.Username, err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+// postgresCreateDatabase returns the statement that creates the database with
+// the options.
+func postgresCreateDatabase(name string, opts DatabaseOptions) string {
+	encoding := opts.Charset
+	if encoding == "" {
+		encoding = "utf-8"
+	}
+
+	query := fmt.Sprintf("CREATE DATABASE %s ENCODING %s", pq.QuoteIdentifier(name), quotePostgresLiteral(encoding))
+
+	// template1 may have been created with another encoding and locale.
+	if !opts.isEmpty() {
+		query += " TEMPLATE template0"
+	}
+
+	collate := opts.Collation
+	if collate == "" {
+		collate = opts.Locale
+	}
+
+	if collate != "" {
+		query += fmt.Sprintf(" LC_COLLATE %s", quotePostgresLiteral(collate))
+	}
+
+	if opts.Locale != "" {
+		query += fmt.Sprintf(" LC_CTYPE %s", quotePostgresLiteral(opts.Locale))
+	}
+
+	return query + ";"
+}
+
+// ValidateOptions returns an error if the server does not know the encoding,
+// or if the collation or the locale is not one of its collations.
+func (db *postgres) ValidateOptions(opts DatabaseOptions) error {
+	if opts.Charset != "" {
+		var encoding int
+
+		err := db.conn.QueryRow("SELECT pg_char_to_encoding($1)", opts.Charset).Scan(&encoding)
+		if err != nil {
+			return fmt.Errorf("checking encoding failed: %s", err.Error())
+		}
+		if encoding < 0 {
+			return fmt.Errorf("encoding %q is not supported by the server", opts.Charset)
+		}
+	}
+
+	locales := []struct{ field, value string }{
+		{"collation", opts.Collation},
+		{"locale", opts.Locale},
+	}
+
+	for _, l := range locales {
+		if l.value == "" || l.value == "C" || l.value == "POSIX" {
+			continue
+		}
+
+		var count int
+
+		// pg_collation stores the locales of the system with a normalised
+		// codeset, e.g. en_US.utf8 for en_US.UTF-8, and the locales of the
+		// existing databases work too.
+		query := `SELECT (SELECT count(*) FROM pg_collation WHERE collcollate IN ($1, $2) OR collname IN ($1, $2))
+			+ (SELECT count(*) FROM pg_database WHERE datcollate IN ($1, $2) OR datctype IN ($1, $2))`
+
+		err := db.conn.QueryRow(query, l.value, normaliseLocale(l.value)).Scan(&count)
+		if err != nil {
+			return fmt.Errorf("checking %s failed: %s", l.field, err.Error())
+		}
+		if count == 0 {
+			return fmt.Errorf("%s %q is not supported by the server", l.field, l.value)
+		}
+	}
+
+	return nil
+}
+
+// normaliseLocale returns the locale with its codeset normalised the way glibc
+// does, i.e. lower case without punctuation: en_US.UTF-8@euro becomes
+// en_US.utf8@euro.
+func normaliseLocale(locale string) string {
+	dot := strings.Index(locale, ".")
+	if dot < 0 {
+		return locale
+	}
+
+	codeset, modifier := locale[dot+1:], ""
+	if at := strings.Index(codeset, "@"); at >= 0 {
+		codeset, modifier = codeset[:at], codeset[at:]
+	}
+
+	normalised := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+
+		return -1
+	}, codeset)
+
+	return locale[:dot+1] + normalised + modifier
+}
+
 func (db *postgres) dbExists(database string) (bool, error) {
 	var count int
 
-	query := fmt.Sprintf("SELECT count(*) FROM pg_database WHERE datistemplate = false AND datname = '%s'", strings.ToLower(database))
+	query := "SELECT count(*) FROM pg_database WHERE datistemplate = false AND datname = $1"
 
-	err := db.conn.QueryRow(query).Scan(&count)
+	err := db.conn.QueryRow(query, database).Scan(&count)
 	if err != nil {
 		return true, fmt.Errorf("executing query failed: %s", err.Error())
 	}
@@ -325,9 +667,9 @@ func (db *postgres) dbExists(database string) (bool, error) {
 func (db *postgres) userExists(user string) (bool, error) {
 	var count int
 
-	query := fmt.Sprintf("SELECT count(1) FROM pg_roles WHERE rolname='%s'", strings.ToLower(user))
+	query := "SELECT count(1) FROM pg_roles WHERE rolname = $1"
 
-	err := db.conn.QueryRow(query).Scan(&count)
+	err := db.conn.QueryRow(query, postgresUserName(user)).Scan(&count)
 	if err != nil {
 		return true, fmt.Errorf("executing query failed: %s", err.Error())
 	}
@@ -337,3 +679,16 @@ func (db *postgres) userExists(user string) (bool, error) {
 
 	return false, nil
 }
+
+// postgresUserName returns the name of a user as Postgres stores it. Users
+// have always been created with unquoted names, which Postgres folds to lower
+// case, so the name is folded the same way everywhere it's used. Databases are
+// created with quoted names and keep their case.
+func postgresUserName(name string) string {
+	return strings.ToLower(name)
+}
+
+// postgresUser quotes the name of a user, folded to lower case.
+func postgresUser(name string) string {
+	return pq.QuoteIdentifier(postgresUserName(name))
+}
@@ -1,172 +1,392 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
-	"path"
 	"path/filepath"
-	"strings"
 	"time"
 
 	"github.com/djavorszky/ddn-common/brwsr"
 	"github.com/djavorszky/ddn-common/inet"
 	"github.com/djavorszky/ddn-common/logger"
-	"github.com/djavorszky/ddn-common/model"
 	"github.com/djavorszky/ddn-common/status"
-	"github.com/djavorszky/notif"
 )
 
-func startImport(dbreq model.DBRequest) {
-	upd8Path := fmt.Sprintf("%s/%s", conf.MasterAddress, "upd8")
+func startImport(j *job) {
+	dbreq := j.req.DBRequest
 
-	ch := notif.New(dbreq.ID, upd8Path)
-	defer close(ch)
+	// A dump with a checksum is downloaded first, so that it's verified before
+	// anything of it is loaded into the database.
+	if si, ok := db.(StreamImporter); ok && canStream(dbreq.DumpLocation) && j.req.Checksum == "" {
+		if streamImport(j, si) {
+			return
+		}
+
+		j.log().Info("Dump %q can't be imported while downloading, downloading it first", dbreq.DumpLocation)
+	}
+
+	j.report(status.DownloadInProgress, "Downloading dump")
+	j.log().Debug("Downloading dump from %q", dbreq.DumpLocation)
+
+	// The checksum has already been validated when the request came in.
+	sum, _ := parseChecksum(j.req.Checksum)
+
+	activeJobs.stage(j, downloadPath("dumps", dbreq.DumpLocation))
+
+	path, err := downloadFile(j.ctx, "dumps", dbreq.DumpLocation, sum)
+	if errors.Is(err, errChecksumMismatch) {
+		j.log().Error("downloaded dump is corrupt: %v", err)
 
-	ch <- notif.Y{StatusCode: status.DownloadInProgress, Msg: "Downloading dump"}
-	logger.Debug("Downloading dump from %q", dbreq.DumpLocation)
+		j.failAndDrop(status.ValidationFailed, "Checksum of the dump is wrong: "+err.Error())
+		return
+	}
 
-	path, err := inet.DownloadFile("dumps", dbreq.DumpLocation)
 	if err != nil {
-		db.DropDatabase(dbreq)
-		logger.Error("could not download file: %v", err)
+		j.log().Error("could not download file: %v", err)
 
-		ch <- notif.Y{StatusCode: status.DownloadFailed, Msg: "Downloading file failed: " + err.Error()}
+		j.failAndDrop(status.DownloadFailed, "Downloading file failed: "+err.Error())
 		return
 	}
 	defer os.Remove(path)
 
-	if isArchive(path) {
-		ch <- notif.Y{StatusCode: status.ExtractingArchive, Msg: "Extracting archive"}
-
-		logger.Debug("Extracting archive: %v", path)
-
-		var (
-			files []string
-			err   error
-		)
-
-		switch filepath.Ext(path) {
-		case ".zip":
-			files, err = unzip(path)
-		case ".gz":
-			files, err = ungzip(path)
-		case ".bz2":
-			files, err = unbzip2(path)
-		case ".tar":
-			files, err = untar(path)
+	if j.isCancelled() {
+		j.fail(status.ImportFailed, "Import cancelled")
+		return
+	}
+
+	format, err := detectFormat(path)
+	if err != nil {
+		j.log().Error("could not detect format of dump: %v", err)
+
+		j.failAndDrop(status.ExtractingArchiveFailed, "Extracting file failed: "+err.Error())
+		return
+	}
+
+	if err = checkSupported(format); err != nil {
+		j.log().Error("import process stopped: %v", err)
+
+		j.failAndDrop(status.ArchiveNotSupported, err.Error())
+		return
+	}
+
+	paths := []string{path}
+
+	if format != formatPlain {
+		j.report(status.ExtractingArchive, "Extracting archive")
+
+		j.log().Debug("Extracting %s archive: %v", format, path)
+
+		dir, err := ioutil.TempDir("dumps", fmt.Sprintf("job%d-", j.id))
+		if err != nil {
+			j.log().Error("could not create folder for extraction: %v", err)
+
+			j.failAndDrop(status.ExtractingArchiveFailed, "Extracting file failed: "+err.Error())
+			return
+		}
+		defer os.RemoveAll(dir)
+
+		activeJobs.stage(j, dir)
+
+		var files []string
+
+		switch format {
+		case formatZip:
+			files, err = unzip(path, dir)
+		case formatTar:
+			files, err = untar(j.ctx, path, dir)
 		default:
-			db.DropDatabase(dbreq)
-			logger.Error("import process stopped; encountered unsupported archive")
+			files, err = decompressFile(j.ctx, path, dir, format)
+		}
+
+		if err == nil && len(files) == 0 {
+			err = fmt.Errorf("archive is empty")
+		}
+
+		if err == nil {
+			paths, err = orderDumpFiles(dir, files)
+		}
+
+		if err != nil {
+			j.log().Error("could not extract archive: %v", err)
+
+			j.failAndDrop(status.ExtractingArchiveFailed, "Extracting file failed: "+err.Error())
+			return
+		}
+	}
+
+	start := time.Now()
 
-			ch <- notif.Y{StatusCode: status.ArchiveNotSupported, Msg: "archive not supported"}
+	// Archives with multiple files are imported one file after the other.
+	for i, path := range paths {
+		if j.isCancelled() {
+			j.fail(status.ImportFailed, "Import cancelled")
 			return
 		}
-		for _, f := range files {
-			defer os.Remove(f)
+
+		var part string
+		if len(paths) > 1 {
+			part = fmt.Sprintf(" (%d/%d: %s)", i+1, len(paths), filepath.Base(path))
 		}
 
+		j.log().Debug("Validating dump: %s", path)
+
+		j.report(status.ValidatingDump, "Validating dump"+part)
+		path, err = db.ValidateDump(path)
 		if err != nil {
-			db.DropDatabase(dbreq)
-			logger.Error("could not extract archive: %v", err)
+			j.log().Error("database validation failed: %v", err)
 
-			ch <- notif.Y{StatusCode: status.ExtractingArchiveFailed, Msg: "Extracting file failed: " + err.Error()}
+			j.failAndDrop(status.ValidationFailed, "Validating dump failed: "+err.Error())
 			return
 		}
 
-		if len(files) > 1 {
-			db.DropDatabase(dbreq)
-			logger.Error("import process stopped; more than one file found in archive")
+		// Dumps are always imported from the dumps folder, as that's what the
+		// database may see as conf.RemoteDumpsDir. The files of a multi-file
+		// archive are prefixed with the job and their position, so that they
+		// can't clash with each other or with the dumps of other jobs.
+		if filepath.Dir(path) != "dumps" {
+			name := filepath.Base(path)
+			if len(paths) > 1 {
+				name = fmt.Sprintf("job%d-%d-%s", j.id, i+1, name)
+			}
 
-			ch <- notif.Y{StatusCode: status.MultipleFilesInArchive, Msg: "Archive contains more than one file, import stopped"}
+			oldPath := path
+			path = filepath.Join("dumps", name)
+
+			err = os.Rename(oldPath, path)
+			if err != nil {
+				j.log().Error("could not move dump to the dumps folder: %v", err)
+
+				j.failAndDrop(status.ImportFailed, "Importing dump failed: "+err.Error())
+				return
+			}
+		}
+
+		path, _ = filepath.Abs(path)
+		defer os.Remove(path)
+
+		activeJobs.stage(j, path)
+
+		dbreq.DumpLocation = path
+
+		if j.isCancelled() {
+			j.fail(status.ImportFailed, "Import cancelled")
 			return
 		}
 
-		path = files[0]
+		j.log().Debug("Importing dump: %v", path)
+		j.report(status.ImportInProgress, "Importing"+part)
+
+		err = db.ImportDatabase(j.ctx, dbreq)
+		if err != nil {
+			j.log().Error("could not import database: %v", err)
+
+			j.failAndDrop(status.ImportFailed, "Importing dump failed: "+err.Error())
+			return
+		}
 	}
 
-	logger.Debug("Validating dump: %s", path)
+	j.log().Debug("Import succeded in %v", time.Since(start))
+	j.report(status.Success, "Completed")
+}
+
+// streamImport imports the dump while it's being downloaded. The dump is
+// decompressed and filtered on the fly, so nothing is written to the disk.
+// It returns false without importing anything if the dump turns out to be
+// an archive that can't be imported this way. Dumps with a checksum are not
+// streamed, as it could only be verified once they're already loaded.
+func streamImport(j *job, si StreamImporter) bool {
+	dbreq := j.req.DBRequest
+
+	j.report(status.DownloadInProgress, "Downloading dump")
+	j.log().Debug("Streaming dump from %q", dbreq.DumpLocation)
 
-	ch <- notif.Y{StatusCode: status.ValidatingDump, Msg: "Validating dump"}
-	path, err = db.ValidateDump(path)
+	body, err := openURL(j.ctx, dbreq.DumpLocation)
 	if err != nil {
-		db.DropDatabase(dbreq)
-		logger.Error("database validation failed: %v", err)
+		j.log().Error("could not download file: %v", err)
 
-		ch <- notif.Y{StatusCode: status.ValidationFailed, Msg: "Validating dump failed: " + err.Error()}
-		return
+		j.failAndDrop(status.DownloadFailed, "Downloading file failed: "+err.Error())
+		return true
 	}
+	defer body.Close()
+
+	// Stops tracking the progress if the dump ends up being downloaded first.
+	ctx, cancel := context.WithCancel(j.ctx)
+	defer cancel()
 
-	if !strings.Contains(path, "dumps") {
-		oldPath := path
-		path = "dumps" + string(os.PathSeparator) + path
+	download := trackProgress(ctx, body, body.length, status.ImportInProgress, "Importing")
 
-		os.Rename(oldPath, path)
+	dump, ok, err := decompressStream(download)
+	if err != nil {
+		j.log().Error("could not extract archive: %v", err)
+
+		j.failAndDrop(status.ExtractingArchiveFailed, "Extracting file failed: "+err.Error())
+		return true
 	}
 
-	path, _ = filepath.Abs(path)
-	defer os.Remove(path)
+	if !ok {
+		return false
+	}
+	defer dump.Close()
 
-	dbreq.DumpLocation = path
+	filtered := filterLines(dump, si.FilteredPrefixes())
+	defer filtered.Close()
 
-	logger.Debug("Importing dump: %v", path)
-	ch <- notif.Y{StatusCode: status.ImportInProgress, Msg: "Importing"}
+	j.report(status.ImportInProgress, "Importing")
 
 	start := time.Now()
 
-	err = db.ImportDatabase(dbreq)
+	err = si.ImportStream(j.ctx, dbreq, filtered)
 	if err != nil {
-		logger.Error("could not import database: %v", err)
+		j.log().Error("could not import database: %v", err)
 
-		ch <- notif.Y{StatusCode: status.ImportFailed, Msg: "Importing dump failed: " + err.Error()}
-		return
+		j.failAndDrop(status.ImportFailed, "Importing dump failed: "+err.Error())
+		return true
 	}
 
-	logger.Debug("Import succeded in %v", time.Since(start))
-	ch <- notif.Y{StatusCode: status.Success, Msg: "Completed"}
+	j.log().Debug("Import succeded in %v", time.Since(start))
+	j.report(status.Success, "Completed")
+
+	return true
 }
 
-func startExport(dbreq model.DBRequest) {
-	upd8Path := fmt.Sprintf("%s/%s", conf.MasterAddress, "upd8")
+func startExport(j *job) {
+	dbreq := j.req.DBRequest
 
-	ch := notif.New(dbreq.ID, upd8Path)
-	defer close(ch)
+	// The compression has already been validated when the request came in.
+	comp, _ := parseCompression(j.req.Compression, j.req.CompressionLevel)
 
-	logger.Debug("Exporting database: %v", dbreq.DatabaseName)
-	ch <- notif.Y{StatusCode: status.ExportInProgress, Msg: "Exporting"}
+	j.log().Debug("Exporting database: %v", dbreq.DatabaseName)
+	j.report(status.ExportInProgress, "Exporting")
 
 	start := time.Now()
 
-	fullDumpFilename, err := db.ExportDatabase(dbreq)
+	if se, ok := db.(StreamExporter); ok {
+		filename, err := streamExport(j, se, comp)
+		if err != nil {
+			j.log().Error("could not export database: %v", err)
+
+			j.fail(status.ExportFailed, "Exporting database failed: "+err.Error())
+			return
+		}
+
+		j.log().Debug("Export succeeded in %v", time.Since(start))
+
+		j.exported(filename)
+		j.report(status.Success, "Export completed:"+filename)
+		return
+	}
+
+	fullDumpFilename, err := db.ExportDatabase(j.ctx, dbreq)
 	if err != nil {
-		logger.Error("could not export database: %v", err)
+		j.log().Error("could not export database: %v", err)
+
+		j.fail(status.ExportFailed, "Exporting database failed: "+err.Error())
+		return
+	}
+
+	dumpPath := filepath.Join(".", "exports", fullDumpFilename)
+
+	if j.isCancelled() {
+		os.Remove(dumpPath)
 
-		ch <- notif.Y{StatusCode: status.ExportFailed, Msg: "Exporting database failed: " + err.Error()}
+		j.fail(status.ExportFailed, "Export cancelled")
 		return
 	}
 
-	// Archive (zip) the created dump file
-	ch <- notif.Y{StatusCode: status.ArchivingDump, Msg: "Zipping dump"}
-	logger.Debug("Zipping dump file: %v", fullDumpFilename)
+	outputFilename := comp.filename(fullDumpFilename)
 
-	inputFiles := []string{filepath.Join(".", "exports", fullDumpFilename)}
-	outputZipFilename := fmt.Sprintf("%s.zip", strings.TrimSuffix(fullDumpFilename, path.Ext(fullDumpFilename)))
+	if outputFilename != fullDumpFilename {
+		j.report(status.ArchivingDump, "Compressing dump")
+		j.log().Debug("Compressing dump file with %s: %v", comp.format, fullDumpFilename)
+
+		outputPath := filepath.Join(".", "exports", outputFilename)
+
+		err = comp.compressFile(dumpPath, outputPath)
+		os.Remove(dumpPath)
+
+		if err != nil {
+			j.log().Error("could not compress dump file: %v", err)
+
+			j.fail(status.ZippingDumpFailed, "Compressing dump failed: "+err.Error())
+			os.Remove(outputPath)
+			return
+		}
+	}
 
-	err = zipFiles(filepath.Join(".", "exports", outputZipFilename), inputFiles)
+	j.log().Debug("Export succeeded in %v", time.Since(start))
 
+	j.exported(outputFilename)
+	j.report(status.Success, "Export completed:"+outputFilename)
+}
+
+// streamExport compresses the dump while it's being written, and returns the
+// name of the compressed file in the exports folder.
+func streamExport(j *job, se StreamExporter, comp compression) (string, error) {
+	dbreq := j.req.DBRequest
+
+	dumpFilename := fmt.Sprintf("%s_%s.sql", dbreq.DatabaseName, time.Now().Format("20060102150405"))
+	outputPath := filepath.Join(workdir, "exports", comp.filename(dumpFilename))
+
+	out, err := os.Create(outputPath)
+	if err != nil {
+		return "", fmt.Errorf("could not create dumpfile '%s': %s", filepath.Base(outputPath), err.Error())
+	}
+	defer out.Close()
+
+	activeJobs.stage(j, outputPath)
+
+	cw, err := comp.newWriter(out, dumpFilename)
 	if err != nil {
-		logger.Error("could not zip dump file: %v", err)
+		os.Remove(outputPath)
+		return "", err
+	}
+
+	err = se.ExportStream(j.ctx, dbreq, cw)
+	if cerr := cw.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("compressing dump failed: %s", cerr.Error())
+	}
+
+	if err == nil {
+		err = out.Close()
+	}
+
+	if err != nil {
+		os.Remove(outputPath)
+		return "", err
+	}
 
-		ch <- notif.Y{StatusCode: status.ZippingDumpFailed, Msg: "Zipping dump failed: " + err.Error()}
-		os.Remove(filepath.Join(".", "exports", outputZipFilename))
-		os.Remove(inputFiles[0])
+	return filepath.Base(outputPath), nil
+}
+
+// startCopy copies the source database of the job to the database of its
+// request. An incomplete copy is dropped, but a database that already existed
+// is left alone, as it belongs to someone else.
+func startCopy(j *job) {
+	dbreq := j.req.DBRequest
+
+	j.log().Debug("Copying database %q to %q", j.req.SourceDatabase, dbreq.DatabaseName)
+	j.report(status.CopyInProgress, "Copying")
+
+	start := time.Now()
+
+	// The target is the job's to drop only once CopyDatabase created it.
+	ctx := withCreated(j.ctx, func() { j.setOwnsDatabase(true) })
+
+	err := db.CopyDatabase(ctx, j.req.SourceDatabase, dbreq)
+	if err != nil {
+		j.log().Error("could not copy database: %v", err)
+
+		j.failAndDrop(statusCopyFailed, "Copying database failed: "+err.Error())
 		return
 	}
 
-	os.Remove(inputFiles[0])
+	j.log().Debug("Copy succeeded in %v", time.Since(start))
 
-	logger.Debug("Export succeeded in %v", time.Since(start))
-	ch <- notif.Y{StatusCode: status.Success, Msg: "Export completed:" + outputZipFilename}
+	j.report(status.Success, "Copy completed")
 }
 
 // This method should always be called asynchronously
@@ -181,11 +401,14 @@ func keepAlive() {
 				logger.Error("Lost connection to master server, will attempt to reconnect once it's back.")
 
 				registered = false
+				agentRegistered.set(0)
 			}
 
 			continue
 		}
 
+		activeJobs.reportInterrupted()
+
 		// If it is, check if we're not registered
 		if !registered {
 			logger.Info("Master server back online.")
@@ -196,6 +419,7 @@ func keepAlive() {
 			}
 
 			registered = true
+			agentRegistered.set(1)
 		}
 
 		respCode := inet.GetResponseCode(endpoint)
@@ -211,6 +435,15 @@ func keepAlive() {
 	}
 }
 
+// pruneJobs removes the finished jobs from the registry after three days. This
+// method should always be called asynchronously
+func pruneJobs() {
+	ticker := time.NewTicker(1 * time.Hour)
+	for range ticker.C {
+		jobs.prune(72 * time.Hour)
+	}
+}
+
 func checkExports() {
 	ticker := time.NewTicker(1 * time.Hour)
 	for range ticker.C {
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/djavorszky/ddn-common/model"
+	"github.com/djavorszky/ddn-common/status"
+)
+
+func TestStartImportMultiFileArchive(t *testing.T) {
+	defer useMaxJobs(1)()
+
+	dir, err := ioutil.TempDir("", "ddn-import")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+
+	os.Chdir(dir)
+	os.Mkdir("dumps", 0755)
+
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	for _, f := range []struct{ name, content string }{
+		{"2-data.sql", "data"},
+		{"1-schema.sql", "schema"},
+	} {
+		w, _ := zw.Create(f.name)
+		w.Write([]byte(f.content))
+	}
+	zw.Close()
+
+	dumps := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(archive.Bytes())
+	}))
+	defer dumps.Close()
+
+	master, stop := startFakeMaster()
+	defer stop()
+
+	// The stub is not a StreamImporter, like Oracle and MSSQL.
+	stub := &stubDB{}
+	defer useDB(stub)()
+
+	maxSize, ratio := conf.MaxExtractedSize, conf.MaxCompressionRatio
+	defer func() { conf.MaxExtractedSize, conf.MaxCompressionRatio = maxSize, ratio }()
+	conf.MaxExtractedSize, conf.MaxCompressionRatio = defaultMaxExtractedSize, defaultMaxCompressionRatio
+
+	r := &jobRegistry{jobs: make(map[int]*job)}
+	j := r.add(importJob, JobRequest{DBRequest: model.DBRequest{DatabaseName: "db", DumpLocation: dumps.URL + "/dump.zip"}}, "")
+
+	go r.run(j, startImport)
+
+	select {
+	case <-j.sent:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Error; import did not finish")
+	}
+
+	if want := []string{"schema", "data"}; !reflect.DeepEqual(stub.imported, want) {
+		t.Errorf("Error; expected the files to be imported in order %v, got %v", want, stub.imported)
+	}
+
+	if n := master.count(status.Success); n != 1 {
+		t.Errorf("Error; expected success to be reported once, got %d", n)
+	}
+
+	if files, _ := ioutil.ReadDir("dumps"); len(files) != 0 {
+		t.Errorf("Error; dumps folder should be cleaned up, got %d files", len(files))
+	}
+}
+
+func TestStartImportFailure(t *testing.T) {
+	defer useMaxJobs(1)()
+
+	dir, err := ioutil.TempDir("", "ddn-import")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+
+	os.Chdir(dir)
+	os.Mkdir("dumps", 0755)
+
+	dumps := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("data"))
+	}))
+	defer dumps.Close()
+
+	master, stop := startFakeMaster()
+	defer stop()
+
+	stub := &stubDB{importErr: errors.New("syntax error")}
+	defer useDB(stub)()
+
+	r := &jobRegistry{jobs: make(map[int]*job)}
+	j := r.add(importJob, JobRequest{DBRequest: model.DBRequest{DatabaseName: "db", Password: "import-password", DumpLocation: dumps.URL + "/dump.sql"}}, "")
+
+	go r.run(j, startImport)
+
+	select {
+	case <-j.sent:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Error; import did not finish")
+	}
+
+	if n := master.count(status.ImportFailed); n != 1 {
+		t.Errorf("Error; expected failure to be reported once, got %d", n)
+	}
+
+	if drops := stub.drops(); !reflect.DeepEqual(drops, []string{"db"}) {
+		t.Errorf("Error; database of the failed import should be dropped once, got %v", drops)
+	}
+
+	if got := secrets.redact("import-password"); got != "import-password" {
+		t.Errorf("Error; password of the job should be forgotten once it's over, got %q", got)
+	}
+}
+
+// streamingStub is a stubDB that imports the dumps while they're downloaded,
+// like MySQL and PostgreSQL.
+type streamingStub struct {
+	*stubDB
+}
+
+func (s streamingStub) ImportStream(ctx context.Context, dbRequest model.DBRequest, r io.Reader) error {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.imported = append(s.imported, string(content))
+
+	return nil
+}
+
+func (s streamingStub) FilteredPrefixes() []string { return nil }
+
+func TestStartImportChecksumMismatch(t *testing.T) {
+	defer useMaxJobs(1)()
+
+	dir, err := ioutil.TempDir("", "ddn-import")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+
+	os.Chdir(dir)
+	os.Mkdir("dumps", 0755)
+
+	dumps := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("data"))
+	}))
+	defer dumps.Close()
+
+	master, stop := startFakeMaster()
+	defer stop()
+
+	stub := &stubDB{}
+	defer useDB(streamingStub{stub})()
+
+	sum := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("other data")))
+
+	r := &jobRegistry{jobs: make(map[int]*job)}
+	j := r.add(importJob, JobRequest{DBRequest: model.DBRequest{DatabaseName: "db", DumpLocation: dumps.URL + "/dump.sql"}, Checksum: sum}, "")
+
+	go r.run(j, startImport)
+
+	select {
+	case <-j.sent:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Error; import did not finish")
+	}
+
+	// The dump is verified before it's loaded, so it's not streamed.
+	if len(stub.imported) != 0 {
+		t.Errorf("Error; dump with a wrong checksum should not be imported, got %v", stub.imported)
+	}
+
+	if n := master.count(status.ValidationFailed); n != 1 {
+		t.Fatalf("Error; expected validation failure to be reported once, got %d", n)
+	}
+
+	master.mu.Lock()
+	last := master.msgs[len(master.msgs)-1]
+	master.mu.Unlock()
+
+	if !strings.Contains(last.Message, "Checksum of the dump is wrong") {
+		t.Errorf("Error; expected the failure to say the checksum is wrong, got %q", last.Message)
+	}
+
+	if drops := stub.drops(); !reflect.DeepEqual(drops, []string{"db"}) {
+		t.Errorf("Error; database of the failed import should be dropped once, got %v", drops)
+	}
+}
+
+func TestCopyDatabaseHandler(t *testing.T) {
+	stub := &stubDB{databases: []string{"source", "taken"}}
+	defer useDB(stub)()
+
+	vendor := conf.Vendor
+	defer func() { conf.Vendor = vendor }()
+	conf.Vendor = "mysql"
+
+	cases := []struct {
+		name string
+		body string
+		code int
+	}{
+		{"invalid json", `{`, http.StatusBadRequest},
+		{"missing source", `{"database_name": "copy"}`, http.StatusBadRequest},
+		{"invalid name", `{"database_name": "co;py", "source_database": "source"}`, http.StatusBadRequest},
+		{"options", `{"database_name": "copy", "source_database": "source", "charset": "utf8mb4"}`, http.StatusBadRequest},
+		{"missing source database", `{"database_name": "copy", "source_database": "missing"}`, http.StatusNotFound},
+		{"existing target", `{"database_name": "Taken", "source_database": "source"}`, http.StatusConflict},
+	}
+
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		copyDatabase(rec, httptest.NewRequest("POST", "/copy-database", strings.NewReader(c.body)))
+
+		if rec.Code != c.code {
+			t.Errorf("Error; %s: expected %d, got %d: %s", c.name, c.code, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestStartCopy(t *testing.T) {
+	defer useMaxJobs(1)()
+
+	cases := []struct {
+		name    string
+		err     error
+		created bool
+		dropped bool
+	}{
+		{"success", nil, true, false},
+		{"failure", errors.New("mysqldump failed"), true, true},
+		{"failure before creating", errors.New("alive check failed"), false, false},
+		{"existing target", fmt.Errorf("creating database failed: database 'copy' %w", errTargetExists), false, false},
+		{"busy source", fmt.Errorf("source database %q %w", "source", errSourceBusy), false, false},
+	}
+
+	master, stop := startFakeMaster()
+	defer stop()
+
+	for _, c := range cases {
+		stub := &stubDB{copyErr: c.err, copyCreates: c.created}
+		restore := useDB(stub)
+
+		r := &jobRegistry{jobs: make(map[int]*job)}
+		j := r.add(copyJob, JobRequest{DBRequest: model.DBRequest{DatabaseName: "copy"}, SourceDatabase: "source"}, "")
+
+		go r.run(j, startCopy)
+
+		select {
+		case <-j.sent:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Error; %s: copy did not finish", c.name)
+		}
+
+		restore()
+
+		if dropped := len(stub.drops()) > 0; dropped != c.dropped {
+			t.Errorf("Error; %s: expected the target to be dropped: %t, got %v", c.name, c.dropped, stub.drops())
+		}
+	}
+
+	if n := master.count(status.Success); n != 1 {
+		t.Errorf("Error; expected one success to be reported, got %d", n)
+	}
+
+	if n := master.count(statusCopyFailed); n != 4 {
+		t.Errorf("Error; expected four failures to be reported, got %d", n)
+	}
+}
+
+func TestStartCopyCancelledWhileQueued(t *testing.T) {
+	_, stop := startFakeMaster()
+	defer stop()
+
+	stub := &stubDB{}
+	defer useDB(stub)()
+
+	r := &jobRegistry{jobs: make(map[int]*job)}
+	j := r.add(copyJob, JobRequest{DBRequest: model.DBRequest{DatabaseName: "copy"}, SourceDatabase: "source"}, "")
+
+	// The copy never started, so the database, if there is one, belongs to
+	// someone else.
+	j.abort("Cancelled on request")
+
+	go r.run(j, startCopy)
+
+	select {
+	case <-j.sent:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Error; cancelled copy did not finish")
+	}
+
+	if drops := stub.drops(); len(drops) != 0 {
+		t.Errorf("Error; database of a copy that never started should not be dropped, got %v", drops)
+	}
+}
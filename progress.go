@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// progressInterval is how often the progress of a download or import is reported.
+const progressInterval = 30 * time.Second
+
+// progressFunc is called periodically with the progress of a long running phase.
+type progressFunc func(statusCode int, msg string)
+
+type progressKey struct{}
+
+// withProgress returns a context that carries fn, which is used to report the
+// progress of readers wrapped with trackProgress.
+func withProgress(ctx context.Context, fn progressFunc) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+// progressReader counts the bytes read through it.
+type progressReader struct {
+	r     io.Reader
+	read  int64
+	total int64
+	start time.Time
+	done  chan struct{}
+	once  int32
+}
+
+// trackProgress wraps r so that the amount of data read from it is reported
+// every progressInterval, until r is exhausted or the context is done. The total
+// is the expected size of r, or -1 if it's not known. If the context carries no
+// progressFunc, r is returned as-is.
+func trackProgress(ctx context.Context, r io.Reader, total int64, statusCode int, label string) io.Reader {
+	fn, ok := ctx.Value(progressKey{}).(progressFunc)
+	if !ok {
+		return r
+	}
+
+	pr := &progressReader{
+		r:     r,
+		total: total,
+		start: time.Now(),
+		done:  make(chan struct{}),
+	}
+
+	go func() {
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-pr.done:
+				return
+			case <-ticker.C:
+				fn(statusCode, fmt.Sprintf("%s: %s", label, pr.String()))
+			}
+		}
+	}()
+
+	return pr
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	atomic.AddInt64(&pr.read, int64(n))
+
+	if err != nil && atomic.CompareAndSwapInt32(&pr.once, 0, 1) {
+		close(pr.done)
+	}
+
+	return n, err
+}
+
+// String returns the progress in a human readable format, along with
+// the throughput and the estimated time remaining if the total is known.
+func (pr *progressReader) String() string {
+	return pr.status(atomic.LoadInt64(&pr.read), time.Since(pr.start))
+}
+
+// status returns the progress after reading read bytes in elapsed time.
+func (pr *progressReader) status(read int64, elapsed time.Duration) string {
+
+	var rate float64
+	if elapsed > 0 {
+		rate = float64(read) / elapsed.Seconds()
+	}
+
+	if pr.total <= 0 {
+		return fmt.Sprintf("%s, %s/s", formatBytes(read), formatBytes(int64(rate)))
+	}
+
+	percent := float64(read) / float64(pr.total) * 100
+
+	eta := "unknown"
+	if rate > 0 && read <= pr.total {
+		remaining := time.Duration(float64(pr.total-read) / rate * float64(time.Second))
+		eta = remaining.Round(time.Second).String()
+	}
+
+	return fmt.Sprintf("%.1f%% (%s of %s), %s/s, ETA %s",
+		percent, formatBytes(read), formatBytes(pr.total), formatBytes(int64(rate)), eta)
+}
+
+// formatBytes formats a size in bytes using binary prefixes, e.g. 1.5 GiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProgressStatus(t *testing.T) {
+	const mib = 1024 * 1024
+
+	tests := []struct {
+		name    string
+		total   int64
+		read    int64
+		elapsed time.Duration
+		want    string
+	}{
+		{"halfway", 100 * mib, 50 * mib, 10 * time.Second, "50.0% (50.0 MiB of 100.0 MiB), 5.0 MiB/s, ETA 10s"},
+		{"rounded ETA", 3 * mib, 1 * mib, 3 * time.Second, "33.3% (1.0 MiB of 3.0 MiB), 341.3 KiB/s, ETA 6s"},
+		{"nothing read", 100 * mib, 0, 10 * time.Second, "0.0% (0 B of 100.0 MiB), 0 B/s, ETA unknown"},
+		{"no time elapsed", 100 * mib, 0, 0, "0.0% (0 B of 100.0 MiB), 0 B/s, ETA unknown"},
+		{"more than total", 1 * mib, 2 * mib, time.Second, "200.0% (2.0 MiB of 1.0 MiB), 2.0 MiB/s, ETA unknown"},
+		{"unknown total", -1, 50 * mib, 10 * time.Second, "50.0 MiB, 5.0 MiB/s"},
+		{"unknown total, nothing read", -1, 0, 0, "0 B, 0 B/s"},
+	}
+
+	for _, tt := range tests {
+		pr := &progressReader{total: tt.total}
+
+		if got := pr.status(tt.read, tt.elapsed); got != tt.want {
+			t.Errorf("%s: status() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := map[int64]string{
+		0:                      "0 B",
+		1023:                   "1023 B",
+		1024:                   "1.0 KiB",
+		1536:                   "1.5 KiB",
+		5 * 1024 * 1024 * 1024: "5.0 GiB",
+	}
+
+	for n, want := range tests {
+		if got := formatBytes(n); got != want {
+			t.Errorf("formatBytes(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import "github.com/djavorszky/ddn-common/model"
+
+// JobRequest is the request of an import, an export or a copy. On top of the
+// fields of the DBRequest, it holds the options that only the agent understands.
+type JobRequest struct {
+	model.DBRequest
+	DatabaseOptions
+
+	// Checksum is the expected checksum of the downloaded dump, in the form
+	// of "sha256:<hex>" or "md5:<hex>". Optional.
+	Checksum string `json:"checksum,omitempty"`
+
+	// Compression is the format the export is compressed with: "zip", "gzip",
+	// "zstd" or "none". Defaults to "zip".
+	Compression string `json:"compression,omitempty"`
+
+	// CompressionLevel is the level of the compression of the export, from 1
+	// up to 9 for zip and gzip, or 19 for zstd. Defaults to the default level
+	// of the format.
+	CompressionLevel int `json:"compression_level,omitempty"`
+
+	// SourceDatabase is the database a copy is made of. The DBRequest holds
+	// the name of the copy and its user.
+	SourceDatabase string `json:"source_database,omitempty"`
+}
+
+// DatabaseOptions are the options of a database created by the agent. Empty
+// fields are set to the defaults in the configuration of the agent.
+type DatabaseOptions struct {
+	// Charset is the character set of the database, e.g. "utf8mb4" on MySQL
+	// or "UTF8" on Postgres.
+	Charset string `json:"charset,omitempty"`
+
+	// Collation is the collation of the database, e.g. "utf8mb4_unicode_ci"
+	// on MySQL or "en_US.UTF-8" (LC_COLLATE) on Postgres.
+	Collation string `json:"collation,omitempty"`
+
+	// Locale is the locale of the database (LC_CTYPE, and LC_COLLATE if no
+	// collation is given) on Postgres. Not supported by MySQL.
+	Locale string `json:"locale,omitempty"`
+}
+
+// CreateRequest is the request to create a database.
+type CreateRequest struct {
+	model.DBRequest
+	DatabaseOptions
+}
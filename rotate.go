@@ -0,0 +1,285 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/djavorszky/ddn-common/logger"
+)
+
+// rotatedFormat is the format of the timestamp appended to the names of the
+// rotated log files.
+const rotatedFormat = "2006-01-02_15-04-05"
+
+// rotatingFile is a log file that is rotated once it grows larger than
+// maxSize or gets older than maxAge. Rotated files are compressed if compress
+// is set, and only the newest keep of them are kept.
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	maxAge   time.Duration
+	keep     int
+	compress bool
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+
+	// cleanMu serialises compressing and pruning the rotated files, so that a
+	// file is not removed while it's being compressed.
+	cleanMu sync.Mutex
+}
+
+// logFile is the log file of the agent, if it doesn't log to the terminal.
+var logFile *rotatingFile
+
+// openRotatingFile opens the log file at path. A file that already exists is
+// rotated first, so that every run of the agent starts a new log.
+func openRotatingFile(path string, maxSize int64, maxAge time.Duration, keep int, compress bool) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, keep: keep, compress: compress}
+
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if info, err := os.Stat(path); err == nil && info.Size() > 0 {
+		if err = rf.rotate(); err != nil {
+			return nil, err
+		}
+
+		return rf, nil
+	}
+
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+
+	return rf, nil
+}
+
+// Write writes p to the log file, rotating it first if it's due.
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.file == nil {
+		return 0, fmt.Errorf("log file %s is closed", rf.path)
+	}
+
+	if rf.due(int64(len(p))) {
+		if err := rf.rotate(); err != nil {
+			// Losing the log is worse than a log file that is too large.
+			fmt.Fprintf(os.Stderr, "rotating log file %s failed: %s\n", rf.path, err.Error())
+		}
+	}
+
+	if rf.file == nil {
+		return 0, fmt.Errorf("log file %s is closed", rf.path)
+	}
+
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+
+	return n, err
+}
+
+// reopen closes and reopens the log file, e.g. after it was moved by an
+// external logrotate.
+func (rf *rotatingFile) reopen() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.file != nil {
+		rf.file.Close()
+		rf.file = nil
+	}
+
+	return rf.open()
+}
+
+// Close closes the log file.
+func (rf *rotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.file == nil {
+		return nil
+	}
+
+	err := rf.file.Close()
+	rf.file = nil
+
+	return err
+}
+
+// due returns whether the file should be rotated before writing n bytes to it.
+func (rf *rotatingFile) due(n int64) bool {
+	if rf.size == 0 {
+		return false
+	}
+
+	if rf.maxSize > 0 && rf.size+n > rf.maxSize {
+		return true
+	}
+
+	return rf.maxAge > 0 && time.Since(rf.opened) >= rf.maxAge
+}
+
+func (rf *rotatingFile) open() error {
+	file, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return fmt.Errorf("opening log file failed: %s", err.Error())
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("reading log file failed: %s", err.Error())
+	}
+
+	rf.file = file
+	rf.size = info.Size()
+	rf.opened = time.Now()
+
+	return nil
+}
+
+// rotate renames the log file to a timestamped name and opens a new one. The
+// rotated file is compressed and the old ones are removed in the background.
+func (rf *rotatingFile) rotate() error {
+	if rf.file != nil {
+		rf.file.Close()
+		rf.file = nil
+	}
+
+	rotated := fmt.Sprintf("%s.%s", rf.path, time.Now().Format(rotatedFormat))
+	for i := 1; exists(rotated) || exists(rotated+".gz"); i++ {
+		rotated = fmt.Sprintf("%s.%s.%d", rf.path, time.Now().Format(rotatedFormat), i)
+	}
+
+	renameErr := os.Rename(rf.path, rotated)
+
+	// The log goes on in a new file even if the old one couldn't be moved.
+	if err := rf.open(); err != nil {
+		return err
+	}
+
+	if renameErr != nil {
+		return fmt.Errorf("renaming log file failed: %s", renameErr.Error())
+	}
+
+	go func() {
+		rf.cleanMu.Lock()
+		defer rf.cleanMu.Unlock()
+
+		if rf.compress {
+			if err := gzipFile(rotated); err != nil {
+				logger.Error("could not compress rotated log file: %v", err)
+			}
+		}
+
+		if err := rf.prune(); err != nil {
+			logger.Error("could not remove old log files: %v", err)
+		}
+	}()
+
+	return nil
+}
+
+// rotatedName matches the timestamp, the optional counter and the optional .gz
+// that are appended to the name of the log file when it's rotated.
+var rotatedName = regexp.MustCompile(`^\.\d{4}-\d{2}-\d{2}_\d{2}-\d{2}-\d{2}(\.\d+)?(\.gz)?$`)
+
+// prune removes the oldest rotated log files, keeping the newest rf.keep. Only
+// the files named like the rotated ones are considered.
+func (rf *rotatingFile) prune() error {
+	if rf.keep <= 0 {
+		return nil
+	}
+
+	dir, base := filepath.Split(rf.path)
+	if dir == "" {
+		dir = "."
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("listing log directory failed: %s", err.Error())
+	}
+
+	var rotated []os.FileInfo
+	for _, info := range infos {
+		name := info.Name()
+		if !info.IsDir() && strings.HasPrefix(name, base) && rotatedName.MatchString(name[len(base):]) {
+			rotated = append(rotated, info)
+		}
+	}
+
+	if len(rotated) <= rf.keep {
+		return nil
+	}
+
+	sort.Slice(rotated, func(i, j int) bool { return rotated[i].ModTime().After(rotated[j].ModTime()) })
+
+	for _, info := range rotated[rf.keep:] {
+		logger.Debug("Removing old log file %s", info.Name())
+
+		if err := os.Remove(filepath.Join(dir, info.Name())); err != nil {
+			return fmt.Errorf("removing %s failed: %s", info.Name(), err.Error())
+		}
+	}
+
+	return nil
+}
+
+// gzipFile compresses the file at path to path.gz and removes the original.
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("opening %s failed: %s", path, err.Error())
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return fmt.Errorf("creating %s.gz failed: %s", path, err.Error())
+	}
+
+	gz := gzip.NewWriter(out)
+
+	_, err = io.Copy(gz, in)
+	if cerr := gz.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(path + ".gz")
+		return fmt.Errorf("compressing %s failed: %s", path, err.Error())
+	}
+
+	// Keep the time of the rotation, which old files are pruned by.
+	if info, err := in.Stat(); err == nil {
+		os.Chtimes(path+".gz", info.ModTime(), info.ModTime())
+	}
+
+	in.Close()
+
+	return os.Remove(path)
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ddn-log")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "agent.log")
+
+	rf, err := openRotatingFile(path, 10, 0, 0, true)
+	if err != nil {
+		t.Fatalf("openRotatingFile: %v", err)
+	}
+	defer rf.Close()
+
+	rf.Write([]byte("first line\n"))
+	rf.Write([]byte("second line\n"))
+
+	content, _ := ioutil.ReadFile(path)
+	if string(content) != "second line\n" {
+		t.Errorf("log file = %q, want only the second line", content)
+	}
+
+	var rotated string
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		matches, _ := filepath.Glob(path + ".*.gz")
+		if len(matches) == 1 && !exists(strings.TrimSuffix(matches[0], ".gz")) {
+			rotated = matches[0]
+			break
+		}
+	}
+
+	if rotated == "" {
+		t.Fatalf("rotated log file was not compressed")
+	}
+
+	f, err := os.Open(rotated)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %v", err)
+	}
+
+	content, _ = ioutil.ReadAll(gz)
+	if string(content) != "first line\n" {
+		t.Errorf("rotated log file = %q, want the first line", content)
+	}
+}
+
+func TestRotatingFilePrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ddn-log")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "agent.log")
+
+	now := time.Now()
+	names := []string{
+		"agent.log.2026-01-03_10-00-00",
+		"agent.log.2026-01-02_10-00-00.1.gz",
+		"agent.log.2026-01-01_10-00-00",
+		"other.log",
+		"agent.log.bak",
+		"agent.logger",
+	}
+
+	for i, name := range names {
+		file := filepath.Join(dir, name)
+		ioutil.WriteFile(file, []byte("x"), 0666)
+
+		mod := now.Add(-time.Duration(i) * time.Hour)
+		os.Chtimes(file, mod, mod)
+	}
+
+	rf := &rotatingFile{path: path, keep: 2}
+	if err := rf.prune(); err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+
+	want := map[string]bool{names[0]: true, names[1]: true, names[2]: false, "other.log": true, "agent.log.bak": true, "agent.logger": true}
+
+	for name, want := range want {
+		if got := exists(filepath.Join(dir, name)); got != want {
+			t.Errorf("%s exists = %t, want %t", name, got, want)
+		}
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"net/http"
 	"net/http/pprof"
 
-	"github.com/djavorszky/ddn-common/srv"
 	"github.com/gorilla/mux"
 )
 
@@ -17,7 +16,11 @@ func Router() *mux.Router {
 		var handler http.Handler
 
 		handler = route.HandlerFunc
-		handler = srv.Logger(handler, route.Name)
+		handler = rejectOnShutdown(handler, route.Name)
+		handler = authenticate(handler, route.Name)
+		handler = instrument(handler, route.Name)
+		handler = logRequest(handler, route.Name)
+		handler = withRequestID(handler)
 
 		router.
 			Methods(route.Method).
@@ -26,9 +29,9 @@ func Router() *mux.Router {
 			Handler(handler)
 	}
 
-	// Add static serving of files in exports directory.
+	// Add static serving of files in exports directory, for signed URLs only.
 	exports := http.StripPrefix("/exports/", http.FileServer(http.Dir(fmt.Sprintf("%s/exports/", workdir))))
-	router.PathPrefix("/exports/").Handler(exports)
+	router.PathPrefix("/exports/").Handler(authenticateExport(exports))
 
 	attachProfiler(router)
 
@@ -36,15 +39,19 @@ func Router() *mux.Router {
 }
 
 func attachProfiler(router *mux.Router) {
-	router.HandleFunc("/debug/pprof/", pprof.Index)
-	router.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
-	router.HandleFunc("/debug/pprof/profile", pprof.Profile)
-	router.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	handle := func(path string, handler http.Handler) {
+		router.Handle(path, authenticate(handler, "pprof"))
+	}
+
+	handle("/debug/pprof/", http.HandlerFunc(pprof.Index))
+	handle("/debug/pprof/cmdline", http.HandlerFunc(pprof.Cmdline))
+	handle("/debug/pprof/profile", http.HandlerFunc(pprof.Profile))
+	handle("/debug/pprof/symbol", http.HandlerFunc(pprof.Symbol))
 
 	// Manually add support for paths linked to by index page at /debug/pprof/
-	router.Handle("/debug/pprof/goroutine", pprof.Handler("goroutine"))
-	router.Handle("/debug/pprof/heap", pprof.Handler("heap"))
-	router.Handle("/debug/pprof/threadcreate", pprof.Handler("threadcreate"))
-	router.Handle("/debug/pprof/block", pprof.Handler("block"))
-	router.Handle("/debug/pprof/mutex", pprof.Handler("mutex"))
+	handle("/debug/pprof/goroutine", pprof.Handler("goroutine"))
+	handle("/debug/pprof/heap", pprof.Handler("heap"))
+	handle("/debug/pprof/threadcreate", pprof.Handler("threadcreate"))
+	handle("/debug/pprof/block", pprof.Handler("block"))
+	handle("/debug/pprof/mutex", pprof.Handler("mutex"))
 }
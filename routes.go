@@ -49,6 +49,30 @@ var routes = Routes{
 		"/export-database",
 		exportDatabase,
 	},
+	route{
+		"copyDatabase",
+		"POST",
+		"/copy-database",
+		copyDatabase,
+	},
+	route{
+		"listJobs",
+		"GET",
+		"/jobs",
+		listJobs,
+	},
+	route{
+		"getJob",
+		"GET",
+		"/jobs/{id:[0-9]+}",
+		getJob,
+	},
+	route{
+		"cancelJob",
+		"DELETE",
+		"/jobs/{id:[0-9]+}",
+		cancelJob,
+	},
 	route{
 		"whoami",
 		"GET",
@@ -61,6 +85,12 @@ var routes = Routes{
 		"/heartbeat",
 		heartbeat,
 	},
+	route{
+		"metrics",
+		"GET",
+		"/metrics",
+		metricsHandler,
+	},
 	route{
 		"echo",
 		"POST",
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// minSecretLength is the length of the shortest secret that is redacted from
+// the logs. Shorter ones would match too much of the log lines.
+const minSecretLength = 4
+
+// minInlineSecretLength is the length of the shortest secret that is redacted
+// inside words too. Shorter ones, e.g. "test", are only redacted where they
+// stand alone, so that test_db is not logged as ****_db.
+const minInlineSecretLength = 8
+
+// redacted replaces the secrets in the logs.
+const redacted = "****"
+
+// secretSet is the set of the secrets that are removed from the log lines.
+// Every secret is counted by the number of times it was added, and it's
+// forgotten once it's removed as many times.
+type secretSet struct {
+	mu     sync.RWMutex
+	counts map[string]int
+	values []string
+}
+
+// secrets are the passwords the agent knows of: the ones in its configuration,
+// and the ones of the requests and jobs that are in progress.
+var secrets = &secretSet{}
+
+// add adds the secret to the set, unless it's too short.
+func (s *secretSet) add(secret string) {
+	if len(secret) < minSecretLength {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.counts == nil {
+		s.counts = make(map[string]int)
+	}
+
+	s.counts[secret]++
+	if s.counts[secret] > 1 {
+		return
+	}
+
+	s.values = append(s.values, secret)
+
+	// Longer secrets are replaced first, so that a secret containing another
+	// one is not only partially redacted.
+	sort.Slice(s.values, func(i, j int) bool { return len(s.values[i]) > len(s.values[j]) })
+}
+
+// remove removes the secret added once, e.g. by a request or a job that
+// finished.
+func (s *secretSet) remove(secret string) {
+	if len(secret) < minSecretLength {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.counts[secret]--
+	if s.counts[secret] > 0 {
+		return
+	}
+
+	delete(s.counts, secret)
+
+	for i, v := range s.values {
+		if v == secret {
+			s.values = append(s.values[:i], s.values[i+1:]...)
+			break
+		}
+	}
+}
+
+// redact returns the text with the secrets replaced.
+func (s *secretSet) redact(text string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, v := range s.values {
+		if len(v) >= minInlineSecretLength {
+			text = strings.Replace(text, v, redacted, -1)
+			continue
+		}
+
+		text = replaceWord(text, v, redacted)
+	}
+
+	return text
+}
+
+// replaceWord replaces the occurrences of old in text that are not part of a
+// longer word.
+func replaceWord(text, old, new string) string {
+	var b strings.Builder
+
+	for {
+		i := strings.Index(text, old)
+		if i < 0 {
+			break
+		}
+
+		end := i + len(old)
+		if (i > 0 && isWordByte(text[i-1])) || (end < len(text) && isWordByte(text[end])) {
+			b.WriteString(text[:i+1])
+			text = text[i+1:]
+			continue
+		}
+
+		b.WriteString(text[:i])
+		b.WriteString(new)
+		text = text[end:]
+	}
+
+	b.WriteString(text)
+
+	return b.String()
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// writeSecretFile writes the content, e.g. a password, to a temporary file
+// that only the agent can read, and returns its path. The file should be
+// removed as soon as it's not needed.
+func writeSecretFile(pattern, content string) (string, error) {
+	file, err := ioutil.TempFile("", pattern)
+	if err != nil {
+		return "", fmt.Errorf("creating temporary file failed: %s", err.Error())
+	}
+
+	// TempFile creates the file with 0600, but umask and platforms vary.
+	if err = file.Chmod(0600); err == nil {
+		_, err = file.WriteString(content)
+	}
+
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("writing temporary file failed: %s", err.Error())
+	}
+
+	return file.Name(), nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLogRedaction(t *testing.T) {
+	s := secrets
+	defer func() { secrets = s }()
+
+	secrets = &secretSet{}
+	secrets.add("hunter2")
+	secrets.add("hunter2-long")
+	secrets.add("abc")
+
+	var buf bytes.Buffer
+
+	l := log.New(&logWriter{out: &buf}, "", 0)
+	l.Printf("[error] mysql -uroot -phunter2-long, retrying with hunter2 as abc")
+
+	if got, want := buf.String()[20:], "[error] mysql -uroot -p****, retrying with **** as abc\n"; got != want {
+		t.Errorf("redacted log line = %q, want %q", got, want)
+	}
+}
+
+func TestSecretSet(t *testing.T) {
+	s := &secretSet{}
+	s.add("test")
+	s.add("hunter2-long")
+	s.add("hunter2-long")
+
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"password test for test_db", "password **** for test_db"},
+		{"user=db password=test", "user=db password=****"},
+		{"-phunter2-long", "-p****"},
+	}
+
+	for _, c := range cases {
+		if got := s.redact(c.in); got != c.want {
+			t.Errorf("redact(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+
+	s.remove("test")
+	s.remove("hunter2-long")
+
+	if got, want := s.redact("test hunter2-long"), "test ****"; got != want {
+		t.Errorf("redact() after removing = %q, want %q", got, want)
+	}
+
+	s.remove("hunter2-long")
+
+	if len(s.values) != 0 || len(s.counts) != 0 {
+		t.Errorf("secrets should be forgotten once removed as many times as added, got %v", s.values)
+	}
+}
+
+func TestMySQLOptionFile(t *testing.T) {
+	got := mysqlOptionFile(`pa\ss"word#1`)
+	want := "[client]\npassword=\"pa\\\\ss\"word#1\"\n"
+
+	if got != want {
+		t.Errorf("mysqlOptionFile() = %q, want %q", got, want)
+	}
+}
+
+func TestSQLCmdScript(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ddn-fake")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The fake sqlcmd prints the script passed with -i, which is its last
+	// argument.
+	fake := filepath.Join(dir, "sqlcmd")
+	ioutil.WriteFile(fake, []byte("#!/bin/sh\nfor last; do :; done\ncat \"$last\"\n"), 0700)
+
+	exec, addr := conf.Exec, conf.LocalDBAddr
+	defer func() { conf.Exec, conf.LocalDBAddr = exec, addr }()
+	conf.Exec, conf.LocalDBAddr = fake, "localhost:1433"
+
+	query := "CREATE LOGIN [user] WITH PASSWORD = N'secret'"
+
+	res := (&mssql{}).sqlcmd(context.Background(), "sa", "pass", query)
+	if res.exitCode != 0 || res.stdout != query {
+		t.Errorf("sqlcmd() = %+v, want the query read from the script", res)
+	}
+
+	if files, _ := filepath.Glob(filepath.Join(os.TempDir(), "ddn-sqlcmd*")); len(files) != 0 {
+		t.Errorf("script should be removed after running sqlcmd, got %v", files)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/djavorszky/ddn-common/inet"
+	"github.com/djavorszky/ddn-common/logger"
+)
+
+// defaultShutdownTimeout is how long the running jobs are waited for on
+// shutdown if it's not configured.
+const defaultShutdownTimeout = 10 * time.Minute
+
+// cancelTimeout is how long the jobs that are cancelled on shutdown are waited
+// for to clean up after themselves and report the cancellation.
+const cancelTimeout = time.Minute
+
+// shutdownMsg is reported for the jobs that are cancelled on shutdown.
+const shutdownMsg = "Cancelled, the agent is shutting down"
+
+// shutdownTimeout is how long the running jobs are waited for on shutdown.
+var shutdownTimeout = defaultShutdownTimeout
+
+// jobRoutes are the routes that start jobs. They are rejected while the agent
+// is shutting down.
+var jobRoutes = map[string]bool{
+	"importDatabase": true,
+	"exportDatabase": true,
+	"copyDatabase":   true,
+}
+
+// shutdown stops the agent gracefully. New jobs are rejected, the running
+// ones are waited for up to shutdownTimeout and cancelled afterwards, and the
+// agent unregisters from the master once the jobs reported their final
+// statuses.
+func shutdown() {
+	running, queued := jobs.counts()
+	logger.Info("Shutting down, waiting up to %s for %d running jobs, cancelling %d queued jobs", shutdownTimeout, running, queued)
+
+	jobs.close()
+
+	if !jobs.drain(shutdownTimeout) {
+		logger.Warn("Jobs did not finish in %s, cancelling them", shutdownTimeout)
+
+		jobs.abortAll(shutdownMsg)
+
+		if !jobs.drain(cancelTimeout) {
+			logger.Error("Jobs did not stop in %s after cancelling them, exiting anyway", cancelTimeout)
+		}
+	}
+
+	if err := unregisterAgent(); err != nil {
+		logger.Error("couldn't unregister from master: %v", err)
+	}
+
+	os.Exit(0)
+}
+
+// rejectOnShutdown rejects the requests to inner with 503 while the agent is
+// shutting down, if the route starts jobs.
+func rejectOnShutdown(inner http.Handler, name string) http.Handler {
+	if !jobRoutes[name] {
+		return inner
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if jobs.isClosed() {
+			msg := inet.Message{Status: statusShuttingDown, Message: "The agent is shutting down, not accepting new jobs"}
+
+			inet.SendResponse(w, http.StatusServiceUnavailable, msg)
+			return
+		}
+
+		inner.ServeHTTP(w, r)
+	})
+}
@@ -1,8 +1,8 @@
-IF NOT EXISTS (SELECT name FROM [sys].[server_principals] WHERE name = '$(name)')
+IF NOT EXISTS (SELECT name FROM [sys].[server_principals] WHERE name = $(nameLiteral))
 Begin
-    CREATE LOGIN $(name) WITH PASSWORD = '$(password)';
+    CREATE LOGIN $(name) WITH PASSWORD = $(password);
     CREATE USER $(name) FOR LOGIN $(name);
     GRANT ALL PRIVILEGES TO $(name);
-    ALTER SERVER ROLE [dbcreator] ADD MEMBER [$(name)];
+    ALTER SERVER ROLE [dbcreator] ADD MEMBER $(name);
 End
 GO
\ No newline at end of file
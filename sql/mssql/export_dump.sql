@@ -0,0 +1,5 @@
+SET NOCOUNT ON;
+
+BACKUP DATABASE $(databaseName)
+    TO DISK = $(dumpPath)
+    WITH COPY_ONLY, FORMAT, INIT, STATS = 10;
\ No newline at end of file
@@ -29,6 +29,7 @@ DECLARE @RestoreStatement NVARCHAR(MAX),
         @dumFileEntryLogicalName NVARCHAR(128),
         @localDataFolder NVARCHAR(MAX),
 		@dumpFile NVARCHAR(MAX) = $(dumpPath),
+		@targetDatabaseName NVARCHAR(128) = $(targetDatabaseName),
 		@newPhysicalName NVARCHAR(128),
 		@fileType CHAR(1)
 
@@ -36,9 +37,9 @@ DECLARE @RestoreStatement NVARCHAR(MAX),
 SELECT top(1) @localDataFolder = physical_name FROM sys.master_files;  
 SET @localDataFolder = REPLACE(@localDataFolder, RIGHT(@localDataFolder, CHARINDEX('\', REVERSE(@localDataFolder))-1),'');
 
-INSERT INTO @fileListTable EXEC('RESTORE FILELISTONLY FROM DISK = ' + @dumpFile + ';');
+INSERT INTO @fileListTable EXEC(N'RESTORE FILELISTONLY FROM DISK = N''' + REPLACE(@dumpFile, N'''', N'''''') + N''';');
 
-SET @RestoreStatement = N'RESTORE DATABASE [$(targetDatabaseName)] FROM DISK='+ @dumpFile + ' WITH REPLACE, ';
+SET @RestoreStatement = N'RESTORE DATABASE ' + QUOTENAME(@targetDatabaseName) + N' FROM DISK = N''' + REPLACE(@dumpFile, N'''', N'''''') + N''' WITH REPLACE, ';
 
 DECLARE dumpFileList CURSOR FOR
 	SELECT
@@ -51,11 +52,11 @@ OPEN dumpFileList
     WHILE @@Fetch_Status = 0
     BEGIN
 		IF @fileType = 'D' 
-			SET @newPhysicalName = '$(targetDatabaseName).mdf';
+			SET @newPhysicalName = @targetDatabaseName + N'.mdf';
 		IF @fileType = 'L' 
-			SET @newPhysicalName = '$(targetDatabaseName)_log.ldf';
-		SET @RestoreStatement = @RestoreStatement + 'MOVE ' + @dumFileEntryLogicalName + 
-        ' TO ' + @localDataFolder +  @newPhysicalName  + ', ';
+			SET @newPhysicalName = @targetDatabaseName + N'_log.ldf';
+		SET @RestoreStatement = @RestoreStatement + N'MOVE N''' + REPLACE(@dumFileEntryLogicalName, N'''', N'''''') +
+        N''' TO N''' + REPLACE(@localDataFolder + @newPhysicalName, N'''', N'''''') + N''', ';
 		FETCH NEXT FROM dumpFileList INTO @fileType, @dumFileEntryLogicalName;
     END
 
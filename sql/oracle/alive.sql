@@ -0,0 +1,8 @@
+WHENEVER OSERROR EXIT FAILURE
+WHENEVER SQLERROR EXIT SQL.SQLCODE
+SET HEADING OFF
+SET FEEDBACK OFF
+
+SELECT 1 FROM dual;
+
+EXIT
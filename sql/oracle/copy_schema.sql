@@ -0,0 +1,45 @@
+WHENEVER OSERROR EXIT FAILURE
+WHENEVER SQLERROR EXIT SQL.SQLCODE
+SET VERIFY OFF
+SET SERVEROUTPUT ON
+SET FEEDBACK OFF
+
+-- Copies the schema &1 into the schema &2, which has to exist already. The
+-- schema is imported with Data Pump over the DDN_COPY_&2 database link, which
+-- connects to the descriptor &3 as &4 identified by &5. The link is created for
+-- the copy, replacing one left behind by an earlier copy to the same schema, and
+-- is dropped by drop_copy_link.sql afterwards.
+
+DECLARE
+	link_count NUMBER;
+	handle     NUMBER;
+	job_state  VARCHAR2(30);
+BEGIN
+	SELECT COUNT(*) INTO link_count FROM user_db_links WHERE db_link LIKE UPPER('DDN_COPY_&2') || '%';
+
+	IF link_count > 0 THEN
+		EXECUTE IMMEDIATE 'DROP DATABASE LINK ddn_copy_&2';
+	END IF;
+
+	EXECUTE IMMEDIATE 'CREATE DATABASE LINK ddn_copy_&2 CONNECT TO &4 IDENTIFIED BY "&5" USING ''&3''';
+
+	handle := DBMS_DATAPUMP.OPEN(operation => 'IMPORT', job_mode => 'SCHEMA', remote_link => UPPER('DDN_COPY_&2'));
+
+	DBMS_DATAPUMP.METADATA_FILTER(handle, 'SCHEMA_EXPR', 'IN (''' || UPPER('&1') || ''')');
+	-- The user already exists with the password of the request.
+	DBMS_DATAPUMP.METADATA_FILTER(handle, 'EXCLUDE_PATH_EXPR', 'IN (''USER'')');
+	DBMS_DATAPUMP.METADATA_REMAP(handle, 'REMAP_SCHEMA', UPPER('&1'), UPPER('&2'));
+	DBMS_DATAPUMP.METADATA_REMAP(handle, 'REMAP_TABLESPACE', UPPER('&1'), UPPER('&2'));
+
+	DBMS_DATAPUMP.START_JOB(handle);
+	DBMS_DATAPUMP.WAIT_FOR_JOB(handle, job_state);
+
+	DBMS_OUTPUT.PUT_LINE('Copying schema &1 to &2 has been ' || job_state);
+
+	IF job_state <> 'COMPLETED' THEN
+		RAISE_APPLICATION_ERROR(-20000, 'Copying schema &1 ended with state ' || job_state);
+	END IF;
+END;
+/
+
+EXIT
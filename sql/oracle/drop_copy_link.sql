@@ -0,0 +1,26 @@
+WHENEVER OSERROR EXIT FAILURE
+WHENEVER SQLERROR EXIT SQL.SQLCODE
+SET VERIFY OFF
+
+-- Drops the database link created by copy_schema.sql for the copy to the
+-- schema &1, as it contains the password of the agent.
+
+DECLARE
+	link_count NUMBER;
+BEGIN
+	SELECT COUNT(*) INTO link_count FROM user_db_links WHERE db_link LIKE UPPER('DDN_COPY_&1') || '%';
+
+	IF link_count > 0 THEN
+		EXECUTE IMMEDIATE 'DROP DATABASE LINK ddn_copy_&1';
+	END IF;
+
+	-- Earlier versions of the agent kept a single link for every copy.
+	SELECT COUNT(*) INTO link_count FROM user_db_links WHERE db_link LIKE 'DDN_LOOPBACK%';
+
+	IF link_count > 0 THEN
+		EXECUTE IMMEDIATE 'DROP DATABASE LINK ddn_loopback';
+	END IF;
+END;
+/
+
+EXIT
@@ -0,0 +1,13 @@
+WHENEVER OSERROR EXIT FAILURE
+WHENEVER SQLERROR EXIT SQL.SQLCODE
+SET HEADING OFF
+SET FEEDBACK OFF
+SET PAGESIZE 0
+SET NEWPAGE NONE
+
+SELECT username FROM dba_users
+ WHERE default_tablespace = username
+   AND username NOT IN ('SYS', 'SYSTEM')
+ ORDER BY username;
+
+EXIT
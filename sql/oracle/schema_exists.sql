@@ -0,0 +1,14 @@
+WHENEVER OSERROR EXIT FAILURE
+WHENEVER SQLERROR EXIT SQL.SQLCODE
+SET VERIFY OFF
+SET HEADING OFF
+SET FEEDBACK OFF
+SET PAGESIZE 0
+
+-- Counts the users and the tablespaces named &1, whichever created them.
+
+SELECT (SELECT COUNT(*) FROM dba_users WHERE username = UPPER('&1'))
+     + (SELECT COUNT(*) FROM dba_tablespaces WHERE tablespace_name = UPPER('&1'))
+  FROM dual;
+
+EXIT
@@ -0,0 +1,21 @@
+package main
+
+import "github.com/djavorszky/ddn-common/status"
+
+// Statuses that are specific to the agent. They complement the ones found in
+// ddn-common/status and follow the same numbering.
+const (
+	statusQueued       int = 11  // Info: the job waits for its turn to run
+	statusUnauthorized int = 210 // Client error: the request is not signed properly
+	statusCopyFailed   int = 312 // Server error: copying the database failed
+	statusShuttingDown int = 313 // Server error: the agent is shutting down
+	statusCancelled    int = 402 // Warning: the job was cancelled on request
+)
+
+func init() {
+	status.Labels[statusQueued] = "Queued"
+	status.Labels[statusUnauthorized] = "Unauthorized"
+	status.Labels[statusCopyFailed] = "Copying database failed"
+	status.Labels[statusShuttingDown] = "Shutting down"
+	status.Labels[statusCancelled] = "Cancelled"
+}
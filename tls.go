@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/djavorszky/ddn-common/logger"
+)
+
+// certificate is a key pair that can be reloaded from its files while the
+// agent is running.
+type certificate struct {
+	certFile, keyFile string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+var (
+	// serverCert is the certificate the agent serves HTTPS with, if any.
+	serverCert *certificate
+
+	// clientCert is the certificate the agent presents to the master, if any.
+	clientCert *certificate
+)
+
+// loadCertificate loads the key pair from the files.
+func loadCertificate(certFile, keyFile string) (*certificate, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("both the certificate and the key have to be specified")
+	}
+
+	c := &certificate{certFile: certFile, keyFile: keyFile}
+
+	err := c.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// reload loads the key pair from the files again. The previous key pair is
+// kept if the files can't be loaded.
+func (c *certificate) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading certificate %q failed: %s", c.certFile, err.Error())
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.mu.Unlock()
+
+	return nil
+}
+
+// get returns the current key pair.
+func (c *certificate) get() *tls.Certificate {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.cert
+}
+
+// setupMasterTLS configures the HTTP client used to call the master, which is
+// shared with notif and inet, to verify the master with conf.MasterCA and to
+// present the client certificate for mutual TLS.
+func setupMasterTLS() error {
+	if conf.MasterCA == "" && conf.ClientCert == "" {
+		return nil
+	}
+
+	tlsConf := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if conf.MasterCA != "" {
+		// The CA is added to the system roots, as dumps may be downloaded
+		// from other servers as well.
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		pem, err := ioutil.ReadFile(conf.MasterCA)
+		if err != nil {
+			return fmt.Errorf("reading CA bundle failed: %s", err.Error())
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("CA bundle %q does not contain any certificates", conf.MasterCA)
+		}
+
+		tlsConf.RootCAs = pool
+	}
+
+	if conf.ClientCert != "" || conf.ClientKey != "" {
+		cert, err := loadCertificate(conf.ClientCert, conf.ClientKey)
+		if err != nil {
+			return fmt.Errorf("client certificate: %v", err)
+		}
+
+		clientCert = cert
+
+		tlsConf.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return clientCert.get(), nil
+		}
+	}
+
+	transport, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		return fmt.Errorf("default transport is not an *http.Transport")
+	}
+
+	transport.TLSClientConfig = tlsConf
+
+	return nil
+}
+
+// listenAndServe serves the handler on the address, over HTTPS if the agent
+// has a certificate.
+func listenAndServe(addr string, handler http.Handler) error {
+	if conf.TLSCert == "" && conf.TLSKey == "" {
+		return http.ListenAndServe(addr, handler)
+	}
+
+	cert, err := loadCertificate(conf.TLSCert, conf.TLSKey)
+	if err != nil {
+		return err
+	}
+
+	serverCert = cert
+
+	server := &http.Server{
+		Addr:    addr,
+		Handler: handler,
+		TLSConfig: &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return serverCert.get(), nil
+			},
+		},
+	}
+
+	return server.ListenAndServeTLS("", "")
+}
+
+// reloadCertificates reloads the certificates of the agent from their files.
+func reloadCertificates() {
+	for _, c := range []*certificate{serverCert, clientCert} {
+		if c == nil {
+			continue
+		}
+
+		if err := c.reload(); err != nil {
+			logger.Error("Could not reload certificate, keeping the previous one: %v", err)
+			continue
+		}
+
+		logger.Info("Reloaded certificate %q", c.certFile)
+	}
+}
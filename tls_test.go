@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a self-signed certificate with the common name and
+// its key into the dir.
+func writeCertificate(t *testing.T, dir, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error; generating key failed: %v", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Error; creating certificate failed: %v", err)
+	}
+
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	return certFile, keyFile
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatalf("Error; could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeCertificate(t, dir, "first")
+
+	c, err := loadCertificate(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Error; loading certificate failed: %v", err)
+	}
+
+	first := c.get()
+
+	writeCertificate(t, dir, "second")
+
+	if err = c.reload(); err != nil {
+		t.Fatalf("Error; reloading certificate failed: %v", err)
+	}
+
+	leaf, _ := x509.ParseCertificate(c.get().Certificate[0])
+	if leaf.Subject.CommonName != "second" {
+		t.Errorf("Error; expected the reloaded certificate, got %q", leaf.Subject.CommonName)
+	}
+
+	ioutil.WriteFile(certFile, []byte("garbage"), 0600)
+
+	if err = c.reload(); err == nil {
+		t.Errorf("Error; reloading an invalid certificate should fail")
+	}
+
+	if c.get() == first || c.get() == nil {
+		t.Errorf("Error; a failed reload should keep the previous certificate")
+	}
+}
@@ -2,9 +2,10 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"os"
 	"os/exec"
 	"strings"
 	"syscall"
@@ -20,24 +21,61 @@ const defaultFailedCode = 1
 // RunCommand executes a command with specified arguments and returns its exitcode, stdout
 // and stderr as well.
 func RunCommand(name string, args ...string) CommandResult {
+	return RunCommandContext(context.Background(), name, args...)
+}
+
+// RunCommandContext works the same way as RunCommand, except that the command is killed
+// if the context is done before the command finishes on its own.
+func RunCommandContext(ctx context.Context, name string, args ...string) CommandResult {
+	return runCommand(ctx, command{name: name, args: args})
+}
+
+// command is a command to run with runCommand. Secrets such as passwords are
+// passed to it in env or on stdin, never in args, as the arguments of a
+// process are visible to every user of the machine.
+type command struct {
+	name  string
+	args  []string
+	env   []string
+	stdin string
+}
+
+// runCommand runs the command and returns its exitcode, stdout and stderr.
+// The environment of the agent is extended with the env of the command.
+func runCommand(ctx context.Context, c command) CommandResult {
 	var (
 		outbuf, errbuf bytes.Buffer
 		exitCode       int
 	)
 
-	logger.Debug("Running command: %s %s", name, args)
+	name, args := c.name, c.args
 
-	cmd := exec.Command(name, args...)
+	logFor(ctx).Debug("Running command: %s %s", name, args)
+
+	cmd := exec.CommandContext(ctx, name, args...)
 	cmd.Stdout = &outbuf
 	cmd.Stderr = &errbuf
 
+	if len(c.env) > 0 {
+		cmd.Env = append(os.Environ(), c.env...)
+	}
+
+	if c.stdin != "" {
+		cmd.Stdin = strings.NewReader(c.stdin)
+	}
+
 	err := cmd.Run()
 	stdout := outbuf.String()
 	stderr := errbuf.String()
 
 	if err != nil {
 		// try to get the exit code
-		if exitError, ok := err.(*exec.ExitError); ok {
+		if ctx.Err() != nil {
+			// The command was killed, so its exit code means nothing.
+			exitCode = defaultFailedCode
+
+			stderr = fmt.Sprintf("%s: %v", name, ctx.Err())
+		} else if exitError, ok := err.(*exec.ExitError); ok {
 			ws := exitError.Sys().(syscall.WaitStatus)
 			exitCode = ws.ExitStatus()
 		} else {
@@ -45,7 +83,7 @@ func RunCommand(name string, args ...string) CommandResult {
 			// in this situation, exit code could not be get, and stderr will be
 			// empty string very likely, so we use the default fail code, and format err
 			// to string and set to stderr
-			logger.Error("Could not get exit code for failed program: %v, %v", name, args)
+			logFor(ctx).Error("Could not get exit code for failed program: %v, %v", name, args)
 
 			exitCode = defaultFailedCode
 
@@ -65,6 +103,23 @@ func RunCommand(name string, args ...string) CommandResult {
 	return CommandResult{stdout, stderr, exitCode}
 }
 
+// parseList splits the output of a command into its lines, dropping
+// the surrounding whitespace and any empty lines.
+func parseList(output string) []string {
+	list := make([]string, 0, 10)
+
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		list = append(list, line)
+	}
+
+	return list
+}
+
 // CommandResult is a struct that contains the stdout, stderr and exitcode
 // of a command that was executed.
 type CommandResult struct {
@@ -112,20 +167,23 @@ func registerAgent() error {
 	}
 
 	registered = true
+	agentRegistered.set(1)
 
 	logger.Info("Registered with master server. Got assigned ID '%d'", agent.ID)
 
 	return nil
 }
 
-func unregisterAgent() {
+func unregisterAgent() error {
 	agent.Up = false
 
 	unregister := fmt.Sprintf("%s/%s", conf.MasterAddress, "unregister")
 	_, err := notif.SndLoc(agent, unregister)
 	if err != nil {
-		logger.Fatal("unregister: %v", err)
+		return fmt.Errorf("unregister: %v", err)
 	}
 
-	log.Fatalf("Successfully unregistered the agent.")
+	logger.Info("Successfully unregistered the agent.")
+
+	return nil
 }